@@ -1,23 +1,27 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/juzeon/epok-forwarder/data"
 	"github.com/juzeon/epok-forwarder/forwarder"
+	"github.com/juzeon/epok-forwarder/geo"
 	"github.com/juzeon/epok-forwarder/util"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 func StartServer(configFile string, config data.Config, forwarderIns *forwarder.Forwarder) error {
-	mux := http.NewServeMux()
-	mux.Handle("/api/reload", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+	// mu guards config and forwarderIns, which are replaced on reload
+	var mu sync.Mutex
+	checkRequest := func(writer http.ResponseWriter, request *http.Request, method string) bool {
 		writer.Header().Set("Content-Type", "text/plain")
-		if request.Method != http.MethodPost {
+		if request.Method != method {
 			writer.WriteHeader(400)
-			writer.Write([]byte("only POST requests are accepted"))
-			return
+			writer.Write([]byte("only " + method + " requests are accepted"))
+			return false
 		}
 		if config.Secret != "" {
 			auth := request.Header.Get("Authorization")
@@ -25,15 +29,29 @@ func StartServer(configFile string, config data.Config, forwarderIns *forwarder.
 			if auth != config.Secret {
 				writer.WriteHeader(403)
 				writer.Write([]byte("unauthorized"))
-				return
+				return false
 			}
 		}
+		return true
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/reload", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkRequest(writer, request, http.MethodPost) {
+			return
+		}
 		newConfig, err := data.ReadConfig(configFile)
 		if err != nil {
 			writer.WriteHeader(500)
 			writer.Write([]byte(err.Error()))
 			return
 		}
+		if err := geo.SetupOptional(newConfig.GeoASN, newConfig.GeoCity); err != nil {
+			writer.WriteHeader(500)
+			writer.Write([]byte(err.Error()))
+			return
+		}
 		slog.Info("Stopping previous forwarder instance...")
 		if err := forwarderIns.Stop(); err != nil {
 			writer.WriteHeader(500)
@@ -62,6 +80,15 @@ func StartServer(configFile string, config data.Config, forwarderIns *forwarder.
 			return
 		}
 	}))
+	mux.Handle("/api/udp-flows", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkRequest(writer, request, http.MethodGet) {
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(forwarderIns.GetUDPFlows())
+	}))
 	slog.Info("Start API server on: " + config.API)
 	return http.ListenAndServe(config.API, mux)
 }
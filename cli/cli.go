@@ -58,6 +58,21 @@ func Reload() {
 		os.Exit(1)
 	}
 }
+func UDPFlows() {
+	validateAPIState()
+	resp, err := client.R().Get("/api/udp-flows")
+	if err != nil {
+		util.ErrExit(err)
+	}
+	res := resp.String()
+	if resp.IsSuccessState() {
+		fmt.Println(res)
+		os.Exit(0)
+	} else {
+		slog.Error("Error listing udp flows: " + res)
+		os.Exit(1)
+	}
+}
 func Generate(baseConfig data.BaseConfig) {
 	err := os.WriteFile(envFile, []byte(fmt.Sprintf(`EPOK_API=%s
 EPOK_SECRET=%s
@@ -3,80 +3,358 @@ package data
 import (
 	"errors"
 	"fmt"
-	"github.com/juzeon/epok-forwarder/geo"
 	"github.com/samber/lo"
 	"gopkg.in/yaml.v3"
-	"log/slog"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	BaseConfig `yaml:",inline"`
 	Hosts      []Host `yaml:"hosts"`
+	// ruleLists is loaded by Validate and shared by every firewall of the config
+	ruleLists *RuleLists
 }
 type BaseConfig struct {
-	Http     int    `yaml:"http"`
-	Https    int    `yaml:"https"`
-	API      string `yaml:"api"`
-	Secret   string `yaml:"secret"`
+	Http        int           `yaml:"http"`
+	Https       int           `yaml:"https"`
+	API         string        `yaml:"api"`
+	Secret      string        `yaml:"secret"`
+	ListRefresh time.Duration `yaml:"list_refresh"`
+	// ResolveTTL caps how long the addresses of a host are cached before it is resolved again. DNS records with a
+	// shorter TTL expire earlier
+	ResolveTTL time.Duration `yaml:"resolve_ttl"`
+	// ClientHelloTimeout bounds reading the ClientHello of a TLS client routed by SNI
+	ClientHelloTimeout time.Duration `yaml:"client_hello_timeout"`
+	Bind               Bind          `yaml:"bind"`
+	Mux                Mux           `yaml:"mux"`
+	// QUIC routes QUIC on UDP of the https port by the SNI of its Initial packets
+	QUIC     bool   `yaml:"quic"`
+	GeoASN   string `yaml:"geo_asn"`
+	GeoCity  string `yaml:"geo_city"`
 	Firewall `yaml:",inline"`
 }
 type Host struct {
-	Host     string    `yaml:"host"`
-	Forwards []Forward `yaml:"forwards"`
-	Firewall `yaml:",inline"`
+	Host         string    `yaml:"host"`
+	DeferResolve bool      `yaml:"defer_resolve"`
+	Via          string    `yaml:"via"`
+	Forwards     []Forward `yaml:"forwards"`
+	Outbound     `yaml:",inline"`
+	Firewall     `yaml:",inline"`
+}
+
+// GetVia returns the upstream proxy that connections to the host go through, or nil if they are dialed directly.
+func (o *Host) GetVia() (*url.URL, error) {
+	if o.Via == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(o.Via)
+	if err != nil {
+		return nil, fmt.Errorf("malformed via: %w", err)
+	}
+	if u.Scheme != ViaSOCKS5 && u.Scheme != ViaHTTP {
+		return nil, errors.New("via must be a socks5:// or http:// url: " + u.Redacted())
+	}
+	if _, port, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("via: %w", err)
+	} else if _, err := parsePort(port); err != nil {
+		return nil, fmt.Errorf("via: %w", err)
+	}
+	return u, nil
+}
+
+// Outbound sets how connections to a host leave the server. Options of a forward override those of its host.
+type Outbound struct {
+	// BindSource is the local IP address to dial from, with at most one address of each family
+	BindSource    Bind   `yaml:"bind_source"`
+	BindInterface string `yaml:"bind_interface"`
+}
+
+func (o *Outbound) Validate() error {
+	if err := o.BindSource.Validate(); err != nil {
+		return fmt.Errorf("bind_source: %w", err)
+	}
+	addrs := o.GetSourceAddrs()
+	if len(lo.UniqBy(addrs, netip.Addr.Is4)) != len(addrs) {
+		return errors.New("bind_source has more than one address of the same family")
+	}
+	return nil
+}
+
+// inherit fills in the options that are not set from parent.
+func (o *Outbound) inherit(parent Outbound) {
+	if o.BindSource == "" {
+		o.BindSource = parent.BindSource
+	}
+	if o.BindInterface == "" {
+		o.BindInterface = parent.BindInterface
+	}
 }
+
+func (o *Outbound) GetSourceAddrs() []netip.Addr {
+	return lo.Map(o.BindSource.getIPs(), func(item string, index int) netip.Addr {
+		return netip.MustParseAddr(item).Unmap()
+	})
+}
+
 type Forward struct {
 	Type             string `yaml:"type"`
 	DisableUDP       bool   `yaml:"disable_udp"`
+	Protocol         string `yaml:"protocol"`
+	Bind             Bind   `yaml:"bind"`
+	TProxy           int    `yaml:"tproxy"`
+	ForwardTCP       `yaml:",inline"`
+	ForwardTLS       `yaml:",inline"`
+	ForwardUDP       `yaml:",inline"`
 	ForwardWeb       `yaml:",inline"`
 	ForwardPortRange `yaml:"port_range,omitempty"`
+	DstRange         ForwardPortRange `yaml:"dst_range,omitempty"`
+	Offset           int              `yaml:"offset"`
 	ForwardPort      `yaml:",inline"`
+	ForwardProxy     `yaml:",inline"`
+	Outbound         `yaml:",inline"`
 	Firewall         `yaml:",inline"`
 }
 
-var tmpPortList []int
-
 func (o *Forward) Validate() error {
+	var errs []error
+	if err := o.Bind.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := o.Outbound.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := o.ForwardTCP.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := o.ForwardUDP.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if o.TProxy != 0 && o.Type != ForwardTypePortRange {
+		errs = append(errs, errors.New("tproxy is only supported by port_range"))
+	}
+	if o.ForwardTLS.IsSet() {
+		if o.Type != ForwardTypePort && o.Type != ForwardTypeWeb {
+			errs = append(errs, errors.New("tls is only supported by port and web"))
+		} else if o.Type == ForwardTypeWeb && o.TLSCert == "" {
+			// Without termination the https traffic of a web forward is relayed as is
+			errs = append(errs, errors.New("tls of web requires tls_cert"))
+		} else if o.Type == ForwardTypePort && o.Protocol == "" {
+			o.Protocol = ProtocolTCP
+		}
+		if err := o.ForwardTLS.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := o.validateProtocol(); err != nil {
+		errs = append(errs, err)
+	} else if o.ForwardTLS.IsSet() && o.HasUDP() {
+		errs = append(errs, errors.New("tls only handles tcp"))
+	}
+	if o.TProxy != 0 {
+		if err := validatePort(o.TProxy); err != nil {
+			errs = append(errs, fmt.Errorf("tproxy: %w", err))
+		}
+	}
 	switch o.Type {
 	case ForwardTypeWeb:
-		return o.ForwardWeb.Validate()
+		errs = append(errs, o.ForwardWeb.Validate())
+	case ForwardTypePort:
+		errs = append(errs, o.ForwardPort.Validate())
+	case ForwardTypePortRange:
+		_, err := o.GetPortMappings()
+		errs = append(errs, err)
+	case ForwardTypeSOCKS5, ForwardTypeHTTPProxy:
+		if err := validatePort(o.ForwardPort.Src); err != nil {
+			errs = append(errs, fmt.Errorf("src: %w", err))
+		}
+		errs = append(errs, o.ForwardProxy.Validate())
+	default:
+		errs = append(errs, errors.New("type is not defined: "+o.Type))
+	}
+	errs = append(errs, o.Firewall.Validate())
+	return errors.Join(errs...)
+}
+
+// Bind is a comma-separated list of local IP addresses to listen on. An empty Bind listens on all addresses of
+// both families, 0.0.0.0 on all IPv4 addresses only and :: on all IPv6 addresses only.
+type Bind string
+
+type ListenAddr struct {
+	Network string
+	Address string
+}
+
+func (o Bind) getIPs() []string {
+	return lo.Map(splitRules(string(o)), func(item string, index int) string {
+		return strings.TrimSuffix(strings.TrimPrefix(item, "["), "]")
+	})
+}
+
+func (o Bind) Validate() error {
+	for _, ip := range o.getIPs() {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			return fmt.Errorf("malformed bind address %s: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+// GetListenAddrs returns the addresses to listen on for port, with protocol (tcp or udp) narrowed to the address
+// family of each bind address.
+func (o Bind) GetListenAddrs(protocol string, port int) []ListenAddr {
+	ips := o.getIPs()
+	if len(ips) == 0 {
+		return []ListenAddr{{Network: protocol, Address: ":" + strconv.Itoa(port)}}
+	}
+	return lo.Map(ips, func(ip string, index int) ListenAddr {
+		addr := netip.MustParseAddr(ip)
+		return ListenAddr{
+			Network: protocol + lo.Ternary(addr.Is4(), "4", "6"),
+			Address: net.JoinHostPort(addr.String(), strconv.Itoa(port)),
+		}
+	})
+}
+
+func (o *Forward) validateProtocol() error {
+	if o.Type != ForwardTypePort && o.Type != ForwardTypePortRange {
+		if o.Protocol != "" {
+			return errors.New("protocol is only supported by port and port_range")
+		}
+		return nil
+	}
+	switch o.Protocol {
+	case "":
+		// disable_udp is kept for compatibility
+		o.Protocol = lo.Ternary(o.DisableUDP, ProtocolTCP, ProtocolBoth)
+	case ProtocolTCP, ProtocolBoth, ProtocolUDP:
+		if o.DisableUDP && o.Protocol != ProtocolTCP {
+			return errors.New("disable_udp conflicts with protocol " + o.Protocol)
+		}
+	default:
+		return errors.New("protocol is not defined: " + o.Protocol)
+	}
+	if o.TProxy != 0 && o.Protocol == ProtocolUDP {
+		return errors.New("tproxy only handles tcp")
+	}
+	return nil
+}
+
+// HasTCP reports whether a port or port_range forward forwards TCP. It is only meaningful after Validate.
+func (o *Forward) HasTCP() bool {
+	return o.Protocol == ProtocolTCP || o.Protocol == ProtocolBoth
+}
+
+// HasUDP reports whether a port or port_range forward forwards UDP. It is only meaningful after Validate.
+func (o *Forward) HasUDP() bool {
+	return o.Protocol == ProtocolUDP || o.Protocol == ProtocolBoth
+}
+
+// GetListenPorts returns the local ports the forward listens on by protocol.
+func (o *Forward) GetListenPorts() (tcp []int, udp []int) {
+	var ports []int
+	switch o.Type {
 	case ForwardTypePort:
-		return o.ForwardPort.Validate()
+		ports = []int{o.ForwardPort.Src}
 	case ForwardTypePortRange:
-		ports, err := o.ForwardPortRange.GetPorts()
-		tmpPortList = append(tmpPortList, ports...)
-		return err
+		mappings, _ := o.GetPortMappings()
+		ports = lo.Map(mappings, func(item PortMapping, index int) int { return item.Src })
+	case ForwardTypeSOCKS5, ForwardTypeHTTPProxy:
+		return []int{o.ForwardPort.Src}, nil
 	default:
-		return errors.New("type is not defined: " + o.Type)
+		return nil, nil
+	}
+	if o.HasTCP() {
+		tcp = lo.Ternary(o.TProxy != 0, []int{o.TProxy}, ports)
+	}
+	if o.HasUDP() {
+		udp = ports
+	}
+	return tcp, udp
+}
+
+type PortMapping struct {
+	Src int
+	Dst int
+}
+
+// GetPortMappings pairs every port of a port_range forward with its destination port, which is the same port
+// unless dst_range or offset is set.
+func (o *Forward) GetPortMappings() ([]PortMapping, error) {
+	srcPorts, err := o.ForwardPortRange.GetPorts()
+	if err != nil {
+		return nil, err
+	}
+	dstPorts := lo.Map(srcPorts, func(item int, index int) int { return item + o.Offset })
+	if o.DstRange != "" {
+		if o.Offset != 0 {
+			return nil, errors.New("dst_range and offset cannot be both set")
+		}
+		if dstPorts, err = o.DstRange.GetPorts(); err != nil {
+			return nil, err
+		}
+		if len(dstPorts) != len(srcPorts) {
+			return nil, fmt.Errorf("port_range has %d ports but dst_range has %d", len(srcPorts), len(dstPorts))
+		}
+	}
+	mappings := make([]PortMapping, len(srcPorts))
+	for i := range srcPorts {
+		if dstPorts[i] < 1 || dstPorts[i] > 65535 {
+			return nil, fmt.Errorf("destination port %d of port %d is out of range", dstPorts[i], srcPorts[i])
+		}
+		mappings[i] = PortMapping{Src: srcPorts[i], Dst: dstPorts[i]}
 	}
+	return mappings, nil
 }
 
 type ForwardPortRange string
 
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is out of range 1-65535", port)
+	}
+	return nil
+}
+
+func parsePort(str string) (int, error) {
+	port, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("malformed port: %s", str)
+	}
+	return port, validatePort(port)
+}
+
 func (f *ForwardPortRange) GetPorts() ([]int, error) {
-	arr := strings.Split(strings.ReplaceAll(string(*f), " ", ""), ",")
+	str := strings.ReplaceAll(string(*f), " ", "")
+	if str == "" {
+		return nil, errors.New("port range is empty")
+	}
 	var ports []int
-	for _, seg := range arr {
-		arr2 := strings.Split(seg, "-")
-		if len(arr2) == 1 {
-			p, err := strconv.Atoi(seg)
+	for _, seg := range strings.Split(str, ",") {
+		arr := strings.Split(seg, "-")
+		if len(arr) == 1 {
+			p, err := parsePort(seg)
 			if err != nil {
 				return nil, err
 			}
 			ports = append(ports, p)
-		} else if len(arr2) == 2 {
-			start, err := strconv.Atoi(arr2[0])
+		} else if len(arr) == 2 {
+			start, err := parsePort(arr[0])
 			if err != nil {
 				return nil, err
 			}
-			end, err := strconv.Atoi(arr2[1])
+			end, err := parsePort(arr[1])
 			if err != nil {
 				return nil, err
 			}
+			if start > end {
+				return nil, fmt.Errorf("reversed range: %s", seg)
+			}
 			for i := start; i <= end; i++ {
 				ports = append(ports, i)
 			}
@@ -84,13 +362,77 @@ func (f *ForwardPortRange) GetPorts() ([]int, error) {
 			return nil, errors.New("malformed: " + seg)
 		}
 	}
+	if dup := lo.FindDuplicates(ports); len(dup) != 0 {
+		return nil, fmt.Errorf("duplicate ports in range %s: %v", str, dup)
+	}
 	return ports, nil
 }
 
+type ForwardTCP struct {
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	Retries        int           `yaml:"retries"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	// KeepAlive is the interval of TCP keepalive probes. Zero uses the system default and a negative value
+	// disables them.
+	KeepAlive time.Duration `yaml:"keepalive"`
+	NoDelay   *bool         `yaml:"no_delay"`
+}
+
+func (o *ForwardTCP) Validate() error {
+	if o.ConnectTimeout < 0 || o.Retries < 0 || o.IdleTimeout < 0 {
+		return errors.New("connect_timeout, retries or idle_timeout is negative")
+	}
+	if o.ConnectTimeout == 0 {
+		o.ConnectTimeout = 10 * time.Second
+	}
+	if o.NoDelay == nil {
+		o.NoDelay = lo.ToPtr(true)
+	}
+	return nil
+}
+
+type ForwardUDP struct {
+	UDPTimeout     time.Duration `yaml:"udp_timeout"`
+	UDPMaxSessions int           `yaml:"udp_max_sessions"`
+}
+
+func (o *ForwardUDP) Validate() error {
+	if o.UDPTimeout < 0 || o.UDPMaxSessions < 0 {
+		return errors.New("udp_timeout or udp_max_sessions is negative")
+	}
+	if o.UDPTimeout == 0 {
+		o.UDPTimeout = 5 * time.Minute
+	}
+	return nil
+}
+
+// ForwardProxy configures a forward that proxies clients to destinations of their choice.
+type ForwardProxy struct {
+	// Users maps usernames to passwords. Without users, clients connect without authentication.
+	Users map[string]string `yaml:"users"`
+	// Destinations defaults to the host of the forward
+	Destinations Destinations `yaml:"destinations"`
+}
+
+func (o *ForwardProxy) Validate() error {
+	if _, err := o.Destinations.Parse(); err != nil {
+		return fmt.Errorf("destinations: %w", err)
+	}
+	return nil
+}
+
 type ForwardWeb struct {
 	Http      int      `yaml:"http"`
 	Https     int      `yaml:"https"`
 	Hostnames []string `yaml:"hostnames"`
+	// ALPN restricts TLS routing to clients offering one of these comma-separated protocols. Such a forward is
+	// preferred over one without ALPN for the same hostname.
+	ALPN string `yaml:"alpn"`
+	// Default routes TLS clients without SNI to this forward
+	Default bool `yaml:"default"`
+	// Listen is the local port to route TLS on by SNI, for protocols other than HTTPS. Default to the top-level
+	// https. A forward with its own port is not routed for http.
+	Listen int `yaml:"listen"`
 }
 
 func (o *ForwardWeb) Validate() error {
@@ -100,7 +442,19 @@ func (o *ForwardWeb) Validate() error {
 	if o.Https == 0 {
 		o.Https = 443
 	}
-	return lo.Ternary(len(o.Hostnames) == 0, errors.New("hostnames being empty"), nil)
+	if o.Listen != 0 {
+		if err := validatePort(o.Listen); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
+	return lo.Ternary(len(o.Hostnames) == 0 && !o.Default, errors.New("hostnames being empty"), nil)
+}
+
+// GetALPN returns the protocols of ALPN.
+func (o *ForwardWeb) GetALPN() []string {
+	return lo.Filter(strings.Split(o.ALPN, ","), func(item string, index int) bool {
+		return item != ""
+	})
 }
 
 type ForwardPort struct {
@@ -112,119 +466,149 @@ func (o *ForwardPort) Validate() error {
 	if o.Src == 0 || o.Dst == 0 {
 		return errors.New("src or dst not set")
 	}
-	tmpPortList = append(tmpPortList, o.Src)
+	if err := validatePort(o.Src); err != nil {
+		return fmt.Errorf("src: %w", err)
+	}
+	if err := validatePort(o.Dst); err != nil {
+		return fmt.Errorf("dst: %w", err)
+	}
 	return nil
 }
 
+// Validate fills in defaults and checks the whole config, reporting every problem found rather than only the
+// first one.
 func (o *Config) Validate() error {
-	tmpPortList = nil
+	v := &validator{sockets: map[string][]listenSocket{}}
 	if o.Http == 0 {
 		o.Http = 80
 	}
-	tmpPortList = append(tmpPortList, o.Http)
+	if err := validatePort(o.Http); err != nil {
+		v.addError(fmt.Errorf("http: %w", err))
+	}
 	if o.Https == 0 {
 		o.Https = 443
 	}
-	tmpPortList = append(tmpPortList, o.Https)
+	if err := validatePort(o.Https); err != nil {
+		v.addError(fmt.Errorf("https: %w", err))
+	}
+	if err := o.Bind.Validate(); err != nil {
+		v.addError(err)
+	} else {
+		v.listen("http", "tcp", o.Bind, o.Http)
+		v.listen("https", "tcp", o.Bind, o.Https)
+		if o.QUIC {
+			v.listen("https", "udp", o.Bind, o.Https)
+		}
+	}
 	if o.API == "" {
 		o.API = "127.0.0.1:2035"
 	}
-	if _, p, err := net.SplitHostPort(o.API); err != nil {
-		return errors.New("malformed api field: " + o.API)
+	if h, p, err := net.SplitHostPort(o.API); err != nil {
+		v.addError(errors.New("malformed api field: " + o.API))
+	} else if p, err := parsePort(p); err != nil {
+		v.addError(fmt.Errorf("api: %w", err))
 	} else {
-		p, err := strconv.Atoi(p)
-		if err != nil {
-			return err
+		v.listen("api", "tcp", Bind(lo.Ternary(net.ParseIP(h) != nil, h, "")), p)
+	}
+	if o.ListRefresh == 0 {
+		o.ListRefresh = 10 * time.Minute
+	}
+	if o.ListRefresh < 0 {
+		v.addError(errors.New("list_refresh must not be negative"))
+	}
+	if o.ResolveTTL == 0 {
+		o.ResolveTTL = time.Minute
+	}
+	if o.ResolveTTL < 0 {
+		v.addError(errors.New("resolve_ttl must not be negative"))
+	}
+	if o.ClientHelloTimeout == 0 {
+		o.ClientHelloTimeout = 5 * time.Second
+	}
+	if o.ClientHelloTimeout < 0 {
+		v.addError(errors.New("client_hello_timeout must not be negative"))
+	}
+	if err := o.Mux.Validate(); err != nil {
+		v.addError(fmt.Errorf("mux: %w", err))
+	}
+	for _, file := range []string{o.GeoASN, o.GeoCity} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			v.addError(fmt.Errorf("error opening geo file: %w", err))
 		}
-		tmpPortList = append(tmpPortList, p)
 	}
+	o.ruleLists = &RuleLists{}
+	o.Firewall.ruleLists = o.ruleLists
+	v.addError(o.Firewall.Validate())
+	// Web forwards with the same listen port share its listener
+	webListens := map[int]bool{o.Https: true}
 	for i := range o.Hosts {
 		host := &o.Hosts[i]
-		if _, err := net.LookupHost(host.Host); err != nil {
-			return fmt.Errorf("error parsing host %s: %w", host.Host, err)
+		host.Host = strings.TrimSuffix(strings.TrimPrefix(host.Host, "["), "]")
+		owner := fmt.Sprintf("hosts[%d] (%s)", i, host.Host)
+		if _, err := host.GetVia(); err != nil {
+			v.addError(fmt.Errorf("%s: %w", owner, err))
+		}
+		if host.Host == "" {
+			v.addError(fmt.Errorf("%s: host not set", owner))
+		} else if !host.DeferResolve && host.Via == "" {
+			// A host behind a proxy is resolved by the proxy
+			if _, err := net.LookupHost(host.Host); err != nil {
+				v.addError(fmt.Errorf("%s: error parsing host: %w", owner, err))
+			}
+		}
+		if err := host.Outbound.Validate(); err != nil {
+			v.addError(fmt.Errorf("%s: %w", owner, err))
+		}
+		host.Firewall.ruleLists = o.ruleLists
+		if err := host.Firewall.Validate(); err != nil {
+			v.addError(fmt.Errorf("%s: %w", owner, err))
 		}
 		for j := range host.Forwards {
 			forward := &host.Forwards[j]
+			owner := fmt.Sprintf("%s: forwards[%d]", owner, j)
+			forward.Outbound.inherit(host.Outbound)
+			forward.Firewall.ruleLists = o.ruleLists
+			if (forward.Type == ForwardTypeSOCKS5 || forward.Type == ForwardTypeHTTPProxy) && forward.Destinations == "" {
+				forward.Destinations = Destinations(host.Host)
+			}
+			if host.Via != "" && forward.Protocol == "" &&
+				(forward.Type == ForwardTypePort || forward.Type == ForwardTypePortRange) {
+				forward.Protocol = ProtocolTCP
+			}
 			if err := forward.Validate(); err != nil {
-				return err
+				v.addError(fmt.Errorf("%s: %w", owner, err))
+				continue
 			}
-		}
-	}
-	if dup := lo.FindDuplicates(tmpPortList); len(dup) != 0 {
-		return errors.New(fmt.Sprintf("duplicate ports to listen on: %v", dup))
-	}
-	return nil
-}
-
-type Firewall struct {
-	Allow string `yaml:"allow"`
-	Deny  string `yaml:"deny"`
-}
-
-func (o *Firewall) CheckAllow(ip net.IP) (allow bool, reason string) {
-	getList := func(str string) []string {
-		str = strings.ToUpper(str)
-		arr := strings.Split(str, ",")
-		arr = lo.Filter(
-			lo.Map(arr, func(item string, index int) string {
-				return strings.TrimSpace(item)
-			}),
-			func(item string, index int) bool {
-				return item != ""
-			},
-		)
-		return arr
-	}
-	ipGeo := geo.GetCountryCode(ip.String())
-	process := func(rules string, allow *bool, allowSet bool, reason *string) {
-		for _, item := range getList(rules) {
-			if item == ip.String() {
-				*allow = allowSet
-				*reason = FirewallReasonIPAddress
-				break
+			if host.Via != "" && forward.HasUDP() {
+				v.addError(fmt.Errorf("%s: udp cannot be forwarded via a proxy", owner))
+			}
+			tcpPorts, udpPorts := forward.GetListenPorts()
+			for _, port := range tcpPorts {
+				v.listen(owner, "tcp", forward.Bind, port)
 			}
-			if item == ipGeo {
-				*allow = allowSet
-				*reason = FirewallReasonGeo
-				break
+			for _, port := range udpPorts {
+				v.listen(owner, "udp", forward.Bind, port)
 			}
-			if _, c, _ := net.ParseCIDR(item); c != nil && c.Contains(ip) {
-				*allow = allowSet
-				*reason = FirewallReasonIPCIDR
-				break
+			if forward.Type == ForwardTypeWeb && forward.Listen != 0 && !webListens[forward.Listen] {
+				webListens[forward.Listen] = true
+				v.listen(owner, "tcp", o.Bind, forward.Listen)
 			}
 		}
 	}
-	allow = true
-	reason = FirewallReasonDefault
-	process(o.Deny, &allow, false, &reason)
-	process(o.Allow, &allow, true, &reason)
-	return allow, reason
+	return errors.Join(v.errs...)
 }
 
-type FirewallArray []Firewall
-
-func (f FirewallArray) CheckAllow(ip net.IP) (allow bool, reason string) {
-	allow = true
-	reason = FirewallReasonDefault
-	for _, firewall := range f {
-		if a, r := firewall.CheckAllow(ip); !a { // deny on this level
-			allow = a
-			reason = r
-		} else if r != FirewallReasonDefault { // allow explicitly on this level
-			allow = a
-			reason = r
+// GetRuleListSources returns every external rule list referenced by any firewall in the config.
+func (o *Config) GetRuleListSources() []string {
+	var sources []string
+	sources = append(sources, o.Firewall.getRuleListSources()...)
+	for _, host := range o.Hosts {
+		sources = append(sources, host.Firewall.getRuleListSources()...)
+		for _, forward := range host.Forwards {
+			sources = append(sources, forward.Firewall.getRuleListSources()...)
 		}
 	}
-	return allow, reason
-}
-func (f FirewallArray) CheckAllowByAddr(addrString string) (allow bool, reason string) {
-	h, _, err := net.SplitHostPort(addrString)
-	if err != nil {
-		slog.Warn("Could not split host port", "err", err)
-		return true, FirewallReasonInternalError
-	}
-	return f.CheckAllow(net.ParseIP(h))
+	return lo.Uniq(sources)
 }
 
 func ReadConfig(configFile string) (Config, error) {
@@ -4,6 +4,19 @@ const (
 	ForwardTypeWeb       = "web"
 	ForwardTypePortRange = "port_range"
 	ForwardTypePort      = "port"
+	ForwardTypeSOCKS5    = "socks5"
+	ForwardTypeHTTPProxy = "http_proxy"
+)
+
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolBoth = "both"
+)
+
+const (
+	ViaSOCKS5 = "socks5"
+	ViaHTTP   = "http"
 )
 
 const (
@@ -11,5 +24,7 @@ const (
 	FirewallReasonIPAddress     = "IP address"
 	FirewallReasonGeo           = "geo"
 	FirewallReasonIPCIDR        = "IP CIDR"
+	FirewallReasonASN           = "asn"
+	FirewallReasonRegion        = "region"
 	FirewallReasonInternalError = "internal error"
 )
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Destinations is a comma-separated allowlist of the destinations a proxy forward may connect to. Each entry is
+// an IP address, an IP CIDR or a host name pattern (with * and ?), optionally followed by :port or :port-port.
+// IPv6 addresses and CIDRs are written in brackets when followed by ports.
+type Destinations string
+
+type DestinationRules []destinationRule
+
+type destinationRule struct {
+	// prefix is set for IP address and IP CIDR entries, pattern for host name entries
+	prefix   netip.Prefix
+	pattern  string
+	portFrom int
+	portTo   int
+}
+
+func (o Destinations) Parse() (DestinationRules, error) {
+	var rules DestinationRules
+	for _, entry := range splitRules(string(o)) {
+		rule, err := parseDestinationRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("malformed destination %s: %w", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseDestinationRule(entry string) (destinationRule, error) {
+	host, ports := entry, ""
+	if strings.HasPrefix(entry, "[") {
+		end := strings.Index(entry, "]")
+		if end == -1 {
+			return destinationRule{}, errors.New("missing ]")
+		}
+		host, ports = entry[1:end], entry[end+1:]
+		if ports != "" && !strings.HasPrefix(ports, ":") {
+			return destinationRule{}, errors.New("unexpected " + ports)
+		}
+		ports = strings.TrimPrefix(ports, ":")
+	} else if strings.Count(entry, ":") == 1 {
+		host, ports, _ = strings.Cut(entry, ":")
+	}
+	rule := destinationRule{portFrom: 1, portTo: 65535}
+	if ports != "" {
+		from, to, isRange := strings.Cut(ports, "-")
+		var err error
+		if rule.portFrom, err = parsePort(from); err != nil {
+			return destinationRule{}, err
+		}
+		rule.portTo = rule.portFrom
+		if isRange {
+			if rule.portTo, err = parsePort(to); err != nil {
+				return destinationRule{}, err
+			}
+		}
+		if rule.portFrom > rule.portTo {
+			return destinationRule{}, errors.New("reversed range: " + ports)
+		}
+	}
+	if host == "" {
+		return destinationRule{}, errors.New("host not set")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		rule.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else if prefix, err := netip.ParsePrefix(host); err == nil {
+		rule.prefix = prefix.Masked()
+		if rule.prefix.Addr().Is4In6() && rule.prefix.Bits() >= 96 {
+			rule.prefix = netip.PrefixFrom(rule.prefix.Addr().Unmap(), rule.prefix.Bits()-96)
+		}
+	} else if strings.ContainsAny(host, "/:[]") {
+		return destinationRule{}, errors.New("not an IP address, IP CIDR or host name: " + host)
+	} else {
+		rule.pattern = strings.ToLower(host)
+	}
+	return rule, nil
+}
+
+// AllowHost reports whether host name entries allow connecting to port on host.
+func (o DestinationRules) AllowHost(host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rule := range o {
+		if rule.pattern != "" && port >= rule.portFrom && port <= rule.portTo && matchWildcard(rule.pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowAddr reports whether IP address and IP CIDR entries allow connecting to port on addr.
+func (o DestinationRules) AllowAddr(addr netip.Addr, port int) bool {
+	addr = normalizeAddr(addr)
+	for _, rule := range o {
+		if rule.prefix.IsValid() && port >= rule.portFrom && port <= rule.portTo && rule.prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
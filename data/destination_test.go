@@ -0,0 +1,35 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/netip"
+	"testing"
+)
+
+func TestDestinations(t *testing.T) {
+	rules, err := Destinations("10.0.0.0/8, 192.168.1.1:22-23, *.internal:443, db.example.com, " +
+		"2001:db8::/32, [2001:db8:1::1]:80").Parse()
+	assert.NoError(t, err)
+	assert.True(t, rules.AllowAddr(netip.MustParseAddr("10.1.2.3"), 8080))
+	assert.True(t, rules.AllowAddr(netip.MustParseAddr("::ffff:10.1.2.3"), 8080))
+	assert.True(t, rules.AllowAddr(netip.MustParseAddr("192.168.1.1"), 23))
+	assert.False(t, rules.AllowAddr(netip.MustParseAddr("192.168.1.1"), 24))
+	assert.True(t, rules.AllowAddr(netip.MustParseAddr("2001:db8:ffff::1"), 22))
+	assert.True(t, rules.AllowAddr(netip.MustParseAddr("2001:db8:1::1"), 80))
+	assert.False(t, rules.AllowAddr(netip.MustParseAddr("2001:db9::1"), 80))
+	assert.True(t, rules.AllowHost("git.internal", 443))
+	assert.True(t, rules.AllowHost("GIT.internal.", 443))
+	assert.False(t, rules.AllowHost("git.internal", 22))
+	assert.True(t, rules.AllowHost("db.example.com", 5432))
+	assert.False(t, rules.AllowHost("example.com", 5432))
+	assert.False(t, rules.AllowHost("evilinternal", 443))
+	assert.False(t, rules.AllowHost("dbxexample.com", 5432))
+	assert.False(t, rules.AllowHost("db.exampleXcom", 5432))
+	assert.False(t, rules.AllowHost("10.1.2.3", 80))
+
+	for _, destinations := range []Destinations{"10.0.0.1:0", "10.0.0.1:100-99", "[2001:db8::1", "a/b", ":80",
+		"[::1]x"} {
+		_, err := destinations.Parse()
+		assert.Error(t, err, destinations)
+	}
+}
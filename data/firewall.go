@@ -0,0 +1,299 @@
+package data
+
+import (
+	"fmt"
+	"github.com/juzeon/epok-forwarder/geo"
+	"github.com/samber/lo"
+	"log/slog"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type Firewall struct {
+	Allow string `yaml:"allow"`
+	Deny  string `yaml:"deny"`
+	// ruleLists holds the entries of the external lists in the rules. It is shared by the firewalls of a config.
+	ruleLists *RuleLists
+	// compiled is shared by all copies of the firewall and set up by Compile.
+	compiled *atomic.Pointer[compiledFirewall]
+}
+
+func splitRules(str string) []string {
+	return lo.Filter(
+		lo.Map(strings.Split(str, ","), func(item string, index int) string {
+			return strings.TrimSpace(item)
+		}),
+		func(item string, index int) bool {
+			return item != ""
+		},
+	)
+}
+
+// getRules returns the uppercased rules of str with every external list expanded to its current entries.
+func (o *Firewall) getRules(str string) []string {
+	var rules []string
+	for _, item := range splitRules(str) {
+		if isRuleListSource(item) {
+			rules = append(rules, o.ruleLists.getEntries(item)...)
+		} else {
+			rules = append(rules, strings.ToUpper(item))
+		}
+	}
+	return rules
+}
+
+func (o *Firewall) getRuleListSources() []string {
+	return lo.Filter(append(splitRules(o.Allow), splitRules(o.Deny)...), func(item string, index int) bool {
+		return isRuleListSource(item)
+	})
+}
+
+// Validate loads the external lists referenced by the firewall that are not loaded yet and compiles its rules.
+// Without rule lists shared through Config.Validate, the firewall gets its own.
+func (o *Firewall) Validate() error {
+	if o.ruleLists == nil {
+		o.ruleLists = &RuleLists{}
+	}
+	for _, source := range o.getRuleListSources() {
+		if err := o.ruleLists.ensure(source); err != nil {
+			return fmt.Errorf("error loading rule list %s: %w", source, err)
+		}
+	}
+	o.Compile()
+	return nil
+}
+
+// Compile builds the lookup structures of the firewall once so that CheckAllow doesn't parse rules on every call.
+// They are rebuilt automatically whenever an external list changes.
+func (o *Firewall) Compile() {
+	o.compiled = &atomic.Pointer[compiledFirewall]{}
+	o.compiled.Store(o.compile())
+}
+
+func (o *Firewall) compile() *compiledFirewall {
+	version := o.ruleLists.getVersion()
+	return &compiledFirewall{
+		version: version,
+		allow:   newRuleSet(o.getRules(o.Allow)),
+		deny:    newRuleSet(o.getRules(o.Deny)),
+	}
+}
+
+func (o *Firewall) getCompiled() *compiledFirewall {
+	if o.compiled == nil {
+		return o.compile()
+	}
+	c := o.compiled.Load()
+	if c.version != o.ruleLists.getVersion() {
+		c = o.compile()
+		o.compiled.Store(c)
+	}
+	return c
+}
+
+// normalizeAddr strips the zone and unmaps IPv4-mapped IPv6 addresses so that they are matched as IPv4.
+func normalizeAddr(addr netip.Addr) netip.Addr {
+	return addr.WithZone("").Unmap()
+}
+
+func (o *Firewall) CheckAllow(ip net.IP) (allow bool, reason string) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		slog.Warn("Could not parse ip", "ip", ip)
+		return true, FirewallReasonInternalError
+	}
+	return o.CheckAllowAddr(addr)
+}
+
+func (o *Firewall) CheckAllowAddr(addr netip.Addr) (allow bool, reason string) {
+	return o.checkAllow(&geoInfo{addr: normalizeAddr(addr)})
+}
+
+func (o *Firewall) checkAllow(info *geoInfo) (allow bool, reason string) {
+	c := o.getCompiled()
+	allow = true
+	reason = FirewallReasonDefault
+	if r, ok := c.deny.match(info); ok {
+		allow = false
+		reason = r
+	}
+	if r, ok := c.allow.match(info); ok {
+		allow = true
+		reason = r
+	}
+	return allow, reason
+}
+
+// geoInfo looks up the geo attributes of an address at most once, and only when a rule needs them.
+type geoInfo struct {
+	addr    netip.Addr
+	country *string
+	asn     *string
+	regions *[]string
+}
+
+func (o *geoInfo) getCountry() string {
+	if o.country == nil {
+		o.country = lo.ToPtr(geo.GetCountryCode(o.addr.String()))
+	}
+	return *o.country
+}
+func (o *geoInfo) getASN() string {
+	if o.asn == nil {
+		asn := geo.GetASN(o.addr.String())
+		o.asn = lo.ToPtr(lo.Ternary(asn == 0, "", "AS"+strconv.FormatUint(uint64(asn), 10)))
+	}
+	return *o.asn
+}
+func (o *geoInfo) getRegions() []string {
+	if o.regions == nil {
+		o.regions = lo.ToPtr(geo.GetRegionCodes(o.addr.String()))
+	}
+	return *o.regions
+}
+
+type compiledFirewall struct {
+	version uint64
+	allow   *ruleSet
+	deny    *ruleSet
+}
+
+// attributeRules maps the values of a geo attribute to the earliest rule naming them.
+type attributeRules struct {
+	rules map[string]int
+	// first is the earliest rule of this attribute, or -1 if there are none.
+	first int
+}
+
+func (o *attributeRules) add(value string, rule int) {
+	if _, ok := o.rules[value]; ok {
+		return
+	}
+	o.rules[value] = rule
+	if o.first == -1 {
+		o.first = rule
+	}
+}
+
+var (
+	asnRuleRegexp    = regexp.MustCompile(`^AS\d+$`)
+	regionRuleRegexp = regexp.MustCompile(`^[A-Z]{2}-[A-Z0-9]{1,3}$`)
+)
+
+// ruleSet is a compiled rule string. Rules are identified by their position so that the first matching rule
+// determines the reason, as when scanning the rules in order.
+type ruleSet struct {
+	ipv4      *prefixTrie
+	ipv6      *prefixTrie
+	reasons   []string
+	countries attributeRules
+	asns      attributeRules
+	regions   attributeRules
+}
+
+func newRuleSet(rules []string) *ruleSet {
+	s := &ruleSet{
+		ipv4:      newPrefixTrie(),
+		ipv6:      newPrefixTrie(),
+		reasons:   make([]string, len(rules)),
+		countries: attributeRules{rules: map[string]int{}, first: -1},
+		asns:      attributeRules{rules: map[string]int{}, first: -1},
+		regions:   attributeRules{rules: map[string]int{}, first: -1},
+	}
+	for i, item := range rules {
+		if addr, err := netip.ParseAddr(item); err == nil {
+			addr = normalizeAddr(addr)
+			s.insertPrefix(netip.PrefixFrom(addr, addr.BitLen()), i, FirewallReasonIPAddress)
+		} else if prefix, err := netip.ParsePrefix(item); err == nil {
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			s.insertPrefix(prefix.Masked(), i, FirewallReasonIPCIDR)
+		} else if asnRuleRegexp.MatchString(item) {
+			s.asns.add(item, i)
+			s.reasons[i] = FirewallReasonASN
+		} else if regionRuleRegexp.MatchString(item) {
+			s.regions.add(item, i)
+			s.reasons[i] = FirewallReasonRegion
+		} else {
+			s.countries.add(item, i)
+			s.reasons[i] = FirewallReasonGeo
+		}
+	}
+	return s
+}
+
+func (o *ruleSet) insertPrefix(prefix netip.Prefix, rule int, reason string) {
+	o.reasons[rule] = reason
+	if prefix.Addr().Is4() {
+		o.ipv4.Insert(prefix, rule)
+	} else {
+		o.ipv6.Insert(prefix, rule)
+	}
+}
+
+// match returns the reason of the first rule matching the address of info. Geo attributes are only looked up
+// when one of their rules could precede every rule matched so far.
+func (o *ruleSet) match(info *geoInfo) (reason string, ok bool) {
+	rule, ok := lo.Ternary(info.addr.Is4(), o.ipv4, o.ipv6).Lookup(info.addr)
+	check := func(attribute *attributeRules, getValues func() []string) {
+		if attribute.first == -1 || ok && attribute.first > rule {
+			return
+		}
+		for _, value := range getValues() {
+			if r, found := attribute.rules[value]; found && (!ok || r < rule) {
+				rule, ok = r, true
+			}
+		}
+	}
+	check(&o.countries, func() []string { return []string{info.getCountry()} })
+	check(&o.asns, func() []string { return []string{info.getASN()} })
+	check(&o.regions, info.getRegions)
+	if !ok {
+		return "", false
+	}
+	return o.reasons[rule], true
+}
+
+type FirewallArray []Firewall
+
+func (f FirewallArray) CheckAllow(ip net.IP) (allow bool, reason string) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		slog.Warn("Could not parse ip", "ip", ip)
+		return true, FirewallReasonInternalError
+	}
+	return f.CheckAllowAddr(addr)
+}
+func (f FirewallArray) CheckAllowAddr(addr netip.Addr) (allow bool, reason string) {
+	allow = true
+	reason = FirewallReasonDefault
+	info := &geoInfo{addr: normalizeAddr(addr)}
+	for _, firewall := range f {
+		if a, r := firewall.checkAllow(info); !a { // deny on this level
+			allow = a
+			reason = r
+		} else if r != FirewallReasonDefault { // allow explicitly on this level
+			allow = a
+			reason = r
+		}
+	}
+	return allow, reason
+}
+func (f FirewallArray) CheckAllowByAddr(addrString string) (allow bool, reason string) {
+	h, _, err := net.SplitHostPort(addrString)
+	if err != nil {
+		slog.Warn("Could not split host port", "err", err)
+		return true, FirewallReasonInternalError
+	}
+	addr, err := netip.ParseAddr(h)
+	if err != nil {
+		slog.Warn("Could not parse ip", "err", err)
+		return true, FirewallReasonInternalError
+	}
+	return f.CheckAllowAddr(addr)
+}
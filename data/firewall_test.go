@@ -0,0 +1,324 @@
+package data
+
+import (
+	"github.com/juzeon/epok-forwarder/geo"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFirewall(t *testing.T) {
+	geo.Setup()
+	f := Firewall{
+		Allow: "",
+		Deny:  "",
+	}
+	ip := net.ParseIP("223.5.5.5")
+	a, r := f.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonDefault, r)
+	f = Firewall{
+		Allow: "",
+		Deny:  "cn",
+	}
+	a, r = f.CheckAllow(ip)
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonGeo, r)
+	f = Firewall{
+		Allow: "223.0.0.0/8",
+		Deny:  "cn",
+	}
+	a, r = f.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonIPCIDR, r)
+	f = Firewall{
+		Allow: "us",
+		Deny:  "223.5.5.5",
+	}
+	a, r = f.CheckAllow(ip)
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonIPAddress, r)
+}
+func TestFirewallArray(t *testing.T) {
+	geo.Setup()
+	ip := net.ParseIP("223.5.5.5")
+	fa := FirewallArray{
+		Firewall{
+			Allow: "",
+			Deny:  "cn",
+		},
+		Firewall{
+			Allow: "223.0.0.0/8",
+			Deny:  "",
+		},
+	}
+	a, r := fa.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonIPCIDR, r)
+	fa = FirewallArray{
+		Firewall{
+			Allow: "0.0.0.0/0",
+			Deny:  "us",
+		},
+		Firewall{
+			Allow: "",
+			Deny:  "223.5.5.5",
+		},
+	}
+	a, r = fa.CheckAllow(ip)
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonIPAddress, r)
+	fa = FirewallArray{
+		Firewall{
+			Allow: "",
+			Deny:  "us",
+		},
+		Firewall{
+			Allow: "",
+			Deny:  "223.6.6.6",
+		},
+	}
+	a, r = fa.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonDefault, r)
+	fa = FirewallArray{
+		Firewall{
+			Allow: "223.5.5.5",
+			Deny:  "",
+		},
+		Firewall{
+			Allow: "",
+			Deny:  "cn",
+		},
+	}
+	a, r = fa.CheckAllow(ip)
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonGeo, r)
+	fa = FirewallArray{
+		Firewall{
+			Allow: "",
+			Deny:  "",
+		},
+		Firewall{
+			Allow: "",
+			Deny:  "",
+		},
+	}
+	a, r = fa.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonDefault, r)
+}
+func TestFirewallRuleList(t *testing.T) {
+	geo.Setup()
+	ip := net.ParseIP("223.5.5.5")
+	file := filepath.Join(t.TempDir(), "deny.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("# bad guys\n223.5.5.5 # inline comment\n\n10.0.0.0/8\n"), 0644))
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("cn\n"))
+	}))
+	defer server.Close()
+	fileFirewall := Firewall{
+		Allow: "",
+		Deny:  "@file:" + file,
+	}
+	assert.NoError(t, fileFirewall.Validate())
+	a, r := fileFirewall.CheckAllow(ip)
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonIPAddress, r)
+	f := Firewall{
+		Allow: "@url:" + server.URL + ",223.5.5.5",
+		Deny:  "0.0.0.0/0",
+	}
+	assert.NoError(t, f.Validate())
+	a, r = f.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonGeo, r)
+	assert.NoError(t, os.WriteFile(file, []byte("223.6.6.6\n"), 0644))
+	assert.NoError(t, fileFirewall.ruleLists.load("@file:"+file))
+	a, r = fileFirewall.CheckAllow(ip)
+	assert.Equal(t, true, a)
+	assert.Equal(t, FirewallReasonDefault, r)
+	f = Firewall{
+		Allow: "",
+		Deny:  "@file:" + file + ".missing",
+	}
+	assert.Error(t, f.Validate())
+}
+
+// legacyCheckAllow is the previous implementation of Firewall.CheckAllow that parses rules on every call.
+func legacyCheckAllow(o Firewall, ip net.IP) (allow bool, reason string) {
+	ipGeo := geo.GetCountryCode(ip.String())
+	process := func(rules string, allow *bool, allowSet bool, reason *string) {
+		for _, item := range strings.Split(strings.ToUpper(rules), ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if item == ip.String() {
+				*allow = allowSet
+				*reason = FirewallReasonIPAddress
+				break
+			}
+			if item == ipGeo {
+				*allow = allowSet
+				*reason = FirewallReasonGeo
+				break
+			}
+			if _, c, _ := net.ParseCIDR(item); c != nil && c.Contains(ip) {
+				*allow = allowSet
+				*reason = FirewallReasonIPCIDR
+				break
+			}
+		}
+	}
+	allow = true
+	reason = FirewallReasonDefault
+	process(o.Deny, &allow, false, &reason)
+	process(o.Allow, &allow, true, &reason)
+	return allow, reason
+}
+
+func randomRules(rnd *rand.Rand, n int) string {
+	var rules []string
+	for i := 0; i < n; i++ {
+		ip := net.IPv4(223, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256)))
+		switch rnd.Intn(5) {
+		case 0:
+			rules = append(rules, lo.Sample([]string{"cn", "us", "jp"}))
+		case 1, 2:
+			rules = append(rules, ip.String())
+		default:
+			rules = append(rules, ip.String()+"/"+strconv.Itoa(8+rnd.Intn(25)))
+		}
+	}
+	return strings.Join(rules, ",")
+}
+
+func TestFirewallCompiledMatchesLegacy(t *testing.T) {
+	geo.Setup()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		f := Firewall{
+			Allow: randomRules(rnd, rnd.Intn(20)),
+			Deny:  randomRules(rnd, rnd.Intn(20)),
+		}
+		f.Compile()
+		for j := 0; j < 50; j++ {
+			ip := net.IPv4(223, byte(rnd.Intn(4)), byte(rnd.Intn(256)), byte(rnd.Intn(256)))
+			a, r := f.CheckAllow(ip)
+			la, lr := legacyCheckAllow(f, ip)
+			assert.Equal(t, la, a, "allow %s deny %s ip %s", f.Allow, f.Deny, ip)
+			assert.Equal(t, lr, r, "allow %s deny %s ip %s", f.Allow, f.Deny, ip)
+		}
+	}
+}
+
+func benchmarkFirewall(b *testing.B, size int, legacy bool) {
+	geo.Setup()
+	rnd := rand.New(rand.NewSource(1))
+	f := Firewall{
+		Allow: "",
+		Deny:  randomRules(rnd, size),
+	}
+	f.Compile()
+	ips := lo.Times(1024, func(index int) net.IP {
+		return net.IPv4(byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256)))
+	})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if legacy {
+			legacyCheckAllow(f, ips[i%len(ips)])
+		} else {
+			f.CheckAllow(ips[i%len(ips)])
+		}
+	}
+}
+
+func BenchmarkFirewall(b *testing.B) {
+	for _, size := range []int{10, 1000, 50000} {
+		b.Run("compiled-"+strconv.Itoa(size), func(b *testing.B) {
+			benchmarkFirewall(b, size, false)
+		})
+		b.Run("legacy-"+strconv.Itoa(size), func(b *testing.B) {
+			benchmarkFirewall(b, size, true)
+		})
+	}
+}
+func TestFirewallIPv6(t *testing.T) {
+	geo.Setup()
+	fa := FirewallArray{
+		Firewall{
+			Allow: "2001:DB8::1,::ffff:10.0.0.0/104",
+			Deny:  "2001:db8::/32,10.0.0.0/8",
+		},
+	}
+	for _, item := range []struct {
+		addr   string
+		allow  bool
+		reason string
+	}{
+		{"[2001:db8::1]:443", true, FirewallReasonIPAddress},
+		{"[2001:db8::2]:443", false, FirewallReasonIPCIDR},
+		{"[2001:db8::2%eth0]:443", false, FirewallReasonIPCIDR},
+		{"[2001:db9::2]:443", true, FirewallReasonDefault},
+		{"[::ffff:10.1.2.3]:443", true, FirewallReasonIPCIDR},
+		{"10.1.2.3:443", true, FirewallReasonIPCIDR},
+		{"[::ffff:11.1.2.3]:443", true, FirewallReasonDefault},
+		{"[2400:3200::1]:443", true, FirewallReasonDefault},
+	} {
+		a, r := fa.CheckAllowByAddr(item.addr)
+		assert.Equal(t, item.allow, a, item.addr)
+		assert.Equal(t, item.reason, r, item.addr)
+	}
+	f := Firewall{
+		Allow: "",
+		Deny:  "cn",
+	}
+	a, r := f.CheckAllow(net.ParseIP("2400:3200::1"))
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonGeo, r)
+	a, r = f.CheckAllow(net.ParseIP("::ffff:223.5.5.5"))
+	assert.Equal(t, false, a)
+	assert.Equal(t, FirewallReasonGeo, r)
+}
+func TestFirewallASNAndRegion(t *testing.T) {
+	info := func() *geoInfo {
+		return &geoInfo{
+			addr:    netip.MustParseAddr("1.1.1.1"),
+			country: lo.ToPtr("CN"),
+			asn:     lo.ToPtr("AS13335"),
+			regions: &[]string{"CN-GD"},
+		}
+	}
+	for _, item := range []struct {
+		allow  string
+		deny   string
+		result bool
+		reason string
+	}{
+		{"", "as13335", false, FirewallReasonASN},
+		{"", "AS4134,cn-gd", false, FirewallReasonRegion},
+		{"cn-gd", "cn", true, FirewallReasonRegion},
+		{"as", "cn-bj,as13335", false, FirewallReasonASN},
+		{"1.1.1.1", "as13335", true, FirewallReasonIPAddress},
+		{"", "cn-gd,as13335,cn", false, FirewallReasonRegion},
+		{"", "cn,as13335,cn-gd", false, FirewallReasonGeo},
+	} {
+		f := Firewall{
+			Allow: item.allow,
+			Deny:  item.deny,
+		}
+		a, r := f.checkAllow(info())
+		assert.Equal(t, item.result, a, item)
+		assert.Equal(t, item.reason, r, item)
+	}
+}
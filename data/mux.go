@@ -0,0 +1,44 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Mux makes the http and https listeners detect the protocol of each connection, like sslh, so that TLS, plain
+// HTTP and other protocols can share a port.
+type Mux struct {
+	Enable bool `yaml:"enable"`
+	// SSH is the host:port SSH clients are relayed to. Default to closing them.
+	SSH string `yaml:"ssh"`
+	// Fallback is the host:port anything else is relayed to, including clients that send nothing within
+	// client_hello_timeout. Default to closing them.
+	Fallback string `yaml:"fallback"`
+}
+
+func (o *Mux) Validate() error {
+	if !o.Enable && (o.SSH != "" || o.Fallback != "") {
+		return errors.New("ssh and fallback require enable")
+	}
+	if err := validateHostPort(o.SSH); err != nil {
+		return fmt.Errorf("ssh: %w", err)
+	}
+	if err := validateHostPort(o.Fallback); err != nil {
+		return fmt.Errorf("fallback: %w", err)
+	}
+	return nil
+}
+
+// validateHostPort checks an optional host:port address.
+func validateHostPort(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.New("malformed address: " + addr)
+	}
+	_, err = parsePort(port)
+	return err
+}
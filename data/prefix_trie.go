@@ -0,0 +1,62 @@
+package data
+
+import (
+	"net/netip"
+)
+
+type prefixTrieNode struct {
+	children [2]int32
+	// rule is the index of the earliest rule ending at this node plus one, or zero if none does.
+	rule int32
+}
+
+// prefixTrie is a binary trie of IP prefixes of a single address family. Nodes live in one slice and refer to
+// each other by index to keep large blocklists compact.
+type prefixTrie struct {
+	nodes []prefixTrieNode
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{nodes: make([]prefixTrieNode, 1)}
+}
+
+func addrBit(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// Insert records rule for prefix, keeping the earlier rule if the prefix is already present.
+func (o *prefixTrie) Insert(prefix netip.Prefix, rule int) {
+	b := prefix.Addr().AsSlice()
+	n := int32(0)
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addrBit(b, i)
+		if o.nodes[n].children[bit] == 0 {
+			o.nodes = append(o.nodes, prefixTrieNode{})
+			o.nodes[n].children[bit] = int32(len(o.nodes) - 1)
+		}
+		n = o.nodes[n].children[bit]
+	}
+	if o.nodes[n].rule == 0 || int(o.nodes[n].rule) > rule+1 {
+		o.nodes[n].rule = int32(rule + 1)
+	}
+}
+
+// Lookup returns the earliest rule among all prefixes containing addr.
+func (o *prefixTrie) Lookup(addr netip.Addr) (rule int, ok bool) {
+	b := addr.AsSlice()
+	best := int32(0)
+	n := int32(0)
+	for i := 0; ; i++ {
+		if r := o.nodes[n].rule; r != 0 && (best == 0 || r < best) {
+			best = r
+		}
+		if i == len(b)*8 {
+			break
+		}
+		n = o.nodes[n].children[addrBit(b, i)]
+		if n == 0 {
+			break
+		}
+	}
+	return int(best) - 1, best != 0
+}
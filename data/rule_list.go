@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"github.com/imroc/req/v3"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ruleListPrefixFile = "@file:"
+	ruleListPrefixURL  = "@url:"
+)
+
+// RuleLists holds the entries of the external lists referenced by the firewalls of a config. Each config loads its
+// own while it is validated, so that a config that fails validation, or is never started, leaves the lists of the
+// running one alone. A list referenced by several firewalls is fetched once.
+type RuleLists struct {
+	// lists maps every loaded source to an *atomic.Pointer[[]string] of its entries
+	lists sync.Map
+	// version is bumped whenever a list is (re)loaded so that compiled firewalls know to rebuild
+	version atomic.Uint64
+}
+
+var ruleListClient = req.C().SetTimeout(30 * time.Second)
+
+func isRuleListSource(item string) bool {
+	item = strings.ToLower(item)
+	return strings.HasPrefix(item, ruleListPrefixFile) || strings.HasPrefix(item, ruleListPrefixURL)
+}
+
+func fetchRuleList(source string) ([]string, error) {
+	var content string
+	switch lower := strings.ToLower(source); {
+	case strings.HasPrefix(lower, ruleListPrefixFile):
+		b, err := os.ReadFile(source[len(ruleListPrefixFile):])
+		if err != nil {
+			return nil, err
+		}
+		content = string(b)
+	case strings.HasPrefix(lower, ruleListPrefixURL):
+		resp, err := ruleListClient.R().Get(source[len(ruleListPrefixURL):])
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsErrorState() {
+			return nil, errors.New("unexpected status: " + resp.Status)
+		}
+		content = resp.String()
+	default:
+		return nil, errors.New("not a rule list: " + source)
+	}
+	return parseRuleList(content), nil
+}
+
+// parseRuleList reads one entry per line. Everything after a # is a comment.
+func parseRuleList(content string) []string {
+	var entries []string
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.ToUpper(strings.TrimSpace(line))
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries
+}
+
+// load fetches the entries of source, replacing the previous ones.
+func (o *RuleLists) load(source string) error {
+	entries, err := fetchRuleList(source)
+	if err != nil {
+		return err
+	}
+	actual, _ := o.lists.LoadOrStore(source, &atomic.Pointer[[]string]{})
+	actual.(*atomic.Pointer[[]string]).Store(&entries)
+	o.version.Add(1)
+	return nil
+}
+
+// ensure fetches the entries of source unless they are loaded already.
+func (o *RuleLists) ensure(source string) error {
+	if _, ok := o.lists.Load(source); ok {
+		return nil
+	}
+	return o.load(source)
+}
+
+func (o *RuleLists) getEntries(source string) []string {
+	if o == nil {
+		return nil
+	}
+	l, ok := o.lists.Load(source)
+	if !ok {
+		return nil
+	}
+	if entries := l.(*atomic.Pointer[[]string]).Load(); entries != nil {
+		return *entries
+	}
+	return nil
+}
+
+func (o *RuleLists) getVersion() uint64 {
+	if o == nil {
+		return 0
+	}
+	return o.version.Load()
+}
+
+// StartRuleListRefresher periodically reloads the external lists referenced by config, which must be validated,
+// until ctx is done. A list that fails to reload keeps its previous entries.
+func StartRuleListRefresher(ctx context.Context, config Config, waitGroup *sync.WaitGroup) {
+	sources := config.GetRuleListSources()
+	if len(sources) == 0 || config.ruleLists == nil {
+		return
+	}
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		ticker := time.NewTicker(config.ListRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, source := range sources {
+				if err := config.ruleLists.load(source); err != nil {
+					slog.Warn("Could not refresh rule list", "source", source, "err", err)
+					continue
+				}
+				slog.Info("Refreshed rule list", "source", source, "entries",
+					len(config.ruleLists.getEntries(source)))
+			}
+		}
+	}()
+}
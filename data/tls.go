@@ -0,0 +1,232 @@
+package data
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/samber/lo"
+	"os"
+	"strings"
+)
+
+// ForwardTLS terminates TLS on the listening side of a forward with TLSCert and TLSKey, and/or originates TLS to
+// the backend with BackendTLS, turning a port forward into a TLS tunnel for plaintext services. Clients can be
+// required to present a certificate issued by ClientCA.
+type ForwardTLS struct {
+	TLSCert  string `yaml:"tls_cert"`
+	TLSKey   string `yaml:"tls_key"`
+	ClientCA string `yaml:"client_ca"`
+	// ClientNames are comma-separated patterns, of which one must match the common name or a SAN of the client
+	// certificate. Default to any certificate issued by ClientCA.
+	ClientNames string `yaml:"client_names"`
+	// ClientCRL lists revoked client certificates, in PEM or DER, signed by a CA of ClientCA.
+	ClientCRL  string `yaml:"client_crl"`
+	BackendTLS bool   `yaml:"backend_tls"`
+	// BackendCA pins the CAs the backend certificate is verified against. Default to the system roots.
+	BackendCA string `yaml:"backend_ca"`
+	// BackendServerName is sent as SNI and verified against the backend certificate. Default to the host.
+	BackendServerName string `yaml:"backend_server_name"`
+}
+
+func (o *ForwardTLS) IsSet() bool {
+	return o.TLSCert != "" || o.TLSKey != "" || o.ClientCA != "" || o.ClientNames != "" || o.ClientCRL != "" ||
+		o.BackendTLS || o.BackendCA != "" || o.BackendServerName != ""
+}
+
+func (o *ForwardTLS) Validate() error {
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if o.TLSCert == "" && o.ClientCA != "" {
+		return errors.New("client_ca requires tls_cert")
+	}
+	if o.ClientCA == "" && (o.ClientNames != "" || o.ClientCRL != "") {
+		return errors.New("client_names and client_crl require client_ca")
+	}
+	if !o.BackendTLS && (o.BackendCA != "" || o.BackendServerName != "") {
+		return errors.New("backend_ca and backend_server_name require backend_tls")
+	}
+	if _, err := o.GetListenConfig(); err != nil {
+		return err
+	}
+	if _, err := o.GetBackendConfig(""); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetListenConfig returns the config to accept TLS clients with, or nil if TLS is not terminated.
+func (o *ForwardTLS) GetListenConfig() (*tls.Config, error) {
+	if o.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("error loading tls_cert: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if o.ClientCA != "" {
+		cas, err := loadCertificates(o.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client_ca: %w", err)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			config.ClientCAs.AddCert(ca)
+		}
+		revoked, err := loadRevoked(o.ClientCRL, cas)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client_crl: %w", err)
+		}
+		names := lo.Filter(strings.Split(o.ClientNames, ","), func(item string, index int) bool {
+			return item != ""
+		})
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyClient(state, names, revoked)
+		}
+	}
+	return config, nil
+}
+
+// revokedCert identifies a certificate by its issuer and serial number.
+type revokedCert struct {
+	issuer string
+	serial string
+}
+
+// verifyClient rejects a client whose verified chains include a revoked certificate, or whose certificate matches
+// none of names if there are any. It runs after the chains are verified against the client CAs.
+func verifyClient(state tls.ConnectionState, names []string, revoked map[revokedCert]bool) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			if revoked[revokedCert{issuer: string(cert.RawIssuer), serial: cert.SerialNumber.String()}] {
+				return fmt.Errorf("client certificate %q is revoked", cert.Subject.String())
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	identities := []string{leaf.Subject.CommonName}
+	identities = append(identities, leaf.DNSNames...)
+	identities = append(identities, leaf.EmailAddresses...)
+	for _, uri := range leaf.URIs {
+		identities = append(identities, uri.String())
+	}
+	for _, ip := range leaf.IPAddresses {
+		identities = append(identities, ip.String())
+	}
+	for _, name := range names {
+		for _, identity := range identities {
+			if identity != "" && matchWildcard(name, identity) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %q is not allowed by client_names", leaf.Subject.String())
+}
+
+// loadRevoked reads the revoked certificates of the CRLs in file, each of which must be signed by one of cas. An
+// empty file name revokes nothing.
+func loadRevoked(file string, cas []*x509.Certificate) (map[revokedCert]bool, error) {
+	revoked := map[revokedCert]bool{}
+	if file == "" {
+		return revoked, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{b}
+	}
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, err
+		}
+		_, ok := lo.Find(cas, func(item *x509.Certificate) bool {
+			return crl.CheckSignatureFrom(item) == nil
+		})
+		if !ok {
+			return nil, fmt.Errorf("crl of %q is not signed by client_ca", crl.Issuer.String())
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[revokedCert{issuer: string(crl.RawIssuer), serial: entry.SerialNumber.String()}] = true
+		}
+	}
+	return revoked, nil
+}
+
+// GetBackendConfig returns the config to dial host with, or nil if TLS is not originated.
+func (o *ForwardTLS) GetBackendConfig(host string) (*tls.Config, error) {
+	if !o.BackendTLS {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: o.BackendServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.ServerName == "" {
+		config.ServerName = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if o.BackendCA != "" {
+		pool, err := loadCertPool(o.BackendCA)
+		if err != nil {
+			return nil, fmt.Errorf("error loading backend_ca: %w", err)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	certs, err := loadCertificates(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// loadCertificates reads the PEM certificates in file.
+func loadCertificates(file string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found in " + file)
+	}
+	return certs, nil
+}
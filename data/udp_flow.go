@@ -0,0 +1,17 @@
+package data
+
+import "time"
+
+// UDPFlow is a snapshot of a client mapping of a UDP forward. In is from the client, out is from the destination.
+type UDPFlow struct {
+	Listen     string    `json:"listen"`
+	Client     string    `json:"client"`
+	Dst        string    `json:"dst"`
+	Denied     bool      `json:"denied"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	Started    time.Time `json:"started"`
+	LastActive time.Time `json:"last_active"`
+}
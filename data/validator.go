@@ -0,0 +1,63 @@
+package data
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+type listenSocket struct {
+	owner    string
+	protocol string
+	// ip is empty when listening on all addresses of both families
+	ip   string
+	port int
+}
+
+// conflicts reports whether both sockets cannot be bound at the same time.
+func (o listenSocket) conflicts(other listenSocket) bool {
+	if o.protocol != other.protocol || o.port != other.port {
+		return false
+	}
+	if o.ip == "" || other.ip == "" || o.ip == other.ip {
+		return true
+	}
+	a, b := netip.MustParseAddr(o.ip), netip.MustParseAddr(other.ip)
+	return a.Is4() == b.Is4() && (a.IsUnspecified() || b.IsUnspecified())
+}
+
+// validator collects the problems of a config and the sockets it listens on, so that conflicting listeners are
+// detected per protocol and bind address.
+type validator struct {
+	// sockets is keyed by protocol and port
+	sockets map[string][]listenSocket
+	errs    []error
+}
+
+func (o *validator) addError(err error) {
+	if err != nil {
+		o.errs = append(o.errs, err)
+	}
+}
+
+// listen records that owner listens on port with protocol (tcp or udp) on every address of bind, which must have
+// been validated.
+func (o *validator) listen(owner string, protocol string, bind Bind, port int) {
+	ips := bind.getIPs()
+	if len(ips) == 0 {
+		ips = []string{""}
+	}
+	for _, ip := range ips {
+		if ip != "" {
+			ip = netip.MustParseAddr(ip).String()
+		}
+		socket := listenSocket{owner: owner, protocol: protocol, ip: ip, port: port}
+		key := fmt.Sprintf("%s/%d", protocol, port)
+		for _, existing := range o.sockets[key] {
+			if socket.conflicts(existing) {
+				o.addError(fmt.Errorf("%s: %s port %d conflicts with %s", owner, protocol, port, existing.owner))
+				break
+			}
+		}
+		o.sockets[key] = append(o.sockets[key], socket)
+	}
+}
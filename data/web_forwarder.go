@@ -1,11 +1,32 @@
 package data
 
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
 type RegisterWebForwarderFunc func(hostname string, dstIP string, dstHttpPort int, dstHttpsPort int)
 
+// DialFunc dials port on a backend host.
+type DialFunc func(ctx context.Context, port int) (net.Conn, error)
+
 type WebForwardTarget struct {
-	Hostname      string
-	DstIP         string
-	DstHttpPort   int
-	DstHttpsPort  int
+	// Hostname is empty for the target of a default forward without hostnames
+	Hostname string
+	// ListenPort is the local port the target is routed on by SNI
+	ListenPort   int
+	ALPN         []string
+	Default      bool
+	DstHost      string
+	DstHttpPort  int
+	DstHttpsPort int
+	Dial         DialFunc
+	// DialUDP dials a UDP socket to a port of the host for QUIC. It is nil if the host is behind a proxy.
+	DialUDP       DialFunc
+	TCPOptions    ForwardTCP
+	UDPOptions    ForwardUDP
 	FirewallArray FirewallArray
+	// TLSConfig terminates TLS on the https port if set, so that the decrypted stream is relayed to DstHttpsPort
+	TLSConfig *tls.Config
 }
@@ -0,0 +1,29 @@
+package data
+
+// matchWildcard reports whether s matches pattern, in which '*' matches any run of bytes and '?' matches a single
+// byte. Unlike go-wildcard, every other byte, '.' included, only matches itself, so that "*.example.com" does not
+// allow "evilexample.com".
+func matchWildcard(pattern string, s string) bool {
+	p, i := 0, 0
+	// star is the position of the last '*' in pattern, and next where in s it resumes on a mismatch
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
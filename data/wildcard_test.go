@@ -0,0 +1,32 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMatchWildcard(t *testing.T) {
+	for _, item := range []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "evilexample.com", false},
+		{"db.internal", "db.internal", true},
+		{"db.internal", "dbxinternal", false},
+		{"db?.internal", "db1.internal", true},
+		{"db?.internal", "db.internal", false},
+		{"db?.internal", "db12.internal", false},
+		{"*", "", true},
+		{"", "", true},
+		{"", "a", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYcZ", false},
+		{"spiffe://corp/*", "spiffe://corp/api/v1", true},
+	} {
+		assert.Equal(t, item.match, matchWildcard(item.pattern, item.s), item.pattern+" "+item.s)
+	}
+}
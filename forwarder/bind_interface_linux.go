@@ -0,0 +1,21 @@
+package forwarder
+
+import (
+	"golang.org/x/sys/unix"
+	"syscall"
+)
+
+// bindToInterface returns a dialer control function that sets SO_BINDTODEVICE, so that the connection leaves
+// through the named interface whatever the routing table says.
+func bindToInterface(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = unix.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package forwarder
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindToInterface(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("bind_interface is only supported on linux")
+	}
+}
@@ -0,0 +1,192 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	"io"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	// maxRecordSize is the largest plaintext TLS record allowed by RFC 8446
+	maxRecordSize = 1 << 14
+	// maxClientHelloSize bounds the ClientHello message, which is far smaller in practice even with post-quantum key
+	// shares and ECH
+	maxClientHelloSize = 64 * 1024
+)
+
+const (
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+)
+
+var errNotClientHello = errors.New("not a tls client hello")
+
+// peekClientHello reads the TLS records carrying the ClientHello from reader, and returns the ClientHello along with
+// every byte consumed from reader so that they can be replayed to the backend. Nothing past the record that
+// completes the ClientHello is read.
+func peekClientHello(reader io.Reader) (*tls.ClientHelloInfo, []byte, error) {
+	var peeked, message []byte
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, nil, err
+		}
+		length := int(header[3])<<8 | int(header[4])
+		if header[0] != recordTypeHandshake || header[1] != 3 {
+			return nil, nil, errNotClientHello
+		}
+		if length == 0 || length > maxRecordSize {
+			return nil, nil, fmt.Errorf("invalid tls record length %d", length)
+		}
+		fragment := make([]byte, length)
+		if _, err := io.ReadFull(reader, fragment); err != nil {
+			return nil, nil, err
+		}
+		peeked = append(append(peeked, header...), fragment...)
+		message = append(message, fragment...)
+		if len(message) < 4 {
+			continue
+		}
+		if message[0] != handshakeTypeClientHello {
+			return nil, nil, errNotClientHello
+		}
+		size := 4 + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+		if size > maxClientHelloSize {
+			return nil, nil, fmt.Errorf("tls client hello of %d bytes is too large", size)
+		}
+		if len(message) >= size {
+			hello, err := parseClientHello(message[:size])
+			if err != nil {
+				return nil, nil, err
+			}
+			return hello, peeked, nil
+		}
+	}
+}
+
+// parseClientHello parses a ClientHello handshake message, including its 4-byte header. Only ServerName,
+// SupportedProtos, SupportedVersions and CipherSuites are filled in. Unknown extensions, such as ECH and GREASE ones,
+// are skipped, and GREASE values are left out, so that the SNI of an ECH ClientHello is the public name of its outer
+// ClientHello.
+func parseClientHello(message []byte) (*tls.ClientHelloInfo, error) {
+	s := cryptobyte.String(message)
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != handshakeTypeClientHello || !s.ReadUint24LengthPrefixed(&body) ||
+		!s.Empty() {
+		return nil, errNotClientHello
+	}
+	hello := &tls.ClientHelloInfo{}
+	var version uint16
+	var sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !body.ReadUint16(&version) || !body.Skip(32) || !body.ReadUint8LengthPrefixed(&sessionID) ||
+		len(sessionID) > 32 || !body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errors.New("malformed tls client hello")
+	}
+	var err error
+	if hello.CipherSuites, err = readUint16List(cipherSuites); err != nil {
+		return nil, fmt.Errorf("malformed tls client hello: cipher suites: %w", err)
+	}
+	if body.Empty() {
+		// Extensions are optional before TLS 1.3
+		hello.SupportedVersions = []uint16{version}
+		return hello, nil
+	}
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) || !body.Empty() {
+		return nil, errors.New("malformed tls client hello: extensions")
+	}
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed tls client hello: extensions")
+		}
+		switch extension {
+		case extensionServerName:
+			hello.ServerName, err = readServerName(data)
+		case extensionALPN:
+			hello.SupportedProtos, err = readALPN(data)
+		case extensionSupportedVersions:
+			var versions cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&versions) || !data.Empty() {
+				err = errors.New("malformed list")
+			} else {
+				hello.SupportedVersions, err = readUint16List(versions)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed tls client hello: extension %d: %w", extension, err)
+		}
+	}
+	if hello.SupportedVersions == nil {
+		hello.SupportedVersions = []uint16{version}
+	}
+	return hello, nil
+}
+
+// readServerName returns the host name of a server_name extension.
+func readServerName(data cryptobyte.String) (string, error) {
+	var names cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&names) || !data.Empty() || names.Empty() {
+		return "", errors.New("malformed list")
+	}
+	for !names.Empty() {
+		var nameType uint8
+		var name cryptobyte.String
+		if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+			return "", errors.New("malformed name")
+		}
+		if nameType == 0 {
+			if len(name) == 0 {
+				return "", errors.New("empty host name")
+			}
+			return string(name), nil
+		}
+	}
+	return "", nil
+}
+
+// readALPN returns the protocols of an application_layer_protocol_negotiation extension.
+func readALPN(data cryptobyte.String) ([]string, error) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) || !data.Empty() || list.Empty() {
+		return nil, errors.New("malformed list")
+	}
+	var protos []string
+	for !list.Empty() {
+		var proto cryptobyte.String
+		if !list.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+			return nil, errors.New("malformed protocol")
+		}
+		protos = append(protos, string(proto))
+	}
+	return protos, nil
+}
+
+// readUint16List reads a list of uint16 values, leaving out GREASE ones.
+func readUint16List(list cryptobyte.String) ([]uint16, error) {
+	if len(list)%2 != 0 {
+		return nil, errors.New("odd length")
+	}
+	values := make([]uint16, 0, len(list)/2)
+	for !list.Empty() {
+		var value uint16
+		list.ReadUint16(&value)
+		if !isGREASE(value) {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// isGREASE reports whether value is one of the reserved values of RFC 8701.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
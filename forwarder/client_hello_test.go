@@ -0,0 +1,156 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/cryptobyte"
+	"io"
+	"net"
+	"testing"
+)
+
+// captureConn records the first flight of a TLS client and fails it so that the handshake stops there.
+type captureConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (o *captureConn) Write(b []byte) (int, error) {
+	o.written.Write(b)
+	return 0, io.ErrClosedPipe
+}
+
+// recordClientHello returns the records of the ClientHello sent by a crypto/tls client with config.
+func recordClientHello(t testing.TB, config *tls.Config) []byte {
+	conn := &captureConn{}
+	assert.Error(t, tls.Client(conn, config).Handshake())
+	return conn.written.Bytes()
+}
+
+// fragment splits the handshake messages in records into records of at most size bytes each.
+func fragment(records []byte, size int) []byte {
+	var message, fragmented []byte
+	for len(records) >= 5 {
+		length := int(records[3])<<8 | int(records[4])
+		message = append(message, records[5:5+length]...)
+		records = records[5+length:]
+	}
+	for len(message) > 0 {
+		n := min(size, len(message))
+		fragmented = append(fragmented, recordTypeHandshake, 3, 1, byte(n>>8), byte(n))
+		fragmented = append(fragmented, message[:n]...)
+		message = message[n:]
+	}
+	return fragmented
+}
+
+// buildClientHello returns a ClientHello record with the extensions added by addExtensions.
+func buildClientHello(addExtensions func(b *cryptobyte.Builder)) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(handshakeTypeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.VersionTLS12)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x2a2a)
+			b.AddUint16(tls.TLS_AES_128_GCM_SHA256)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		b.AddUint16LengthPrefixed(addExtensions)
+	})
+	message := b.BytesOrPanic()
+	return append([]byte{recordTypeHandshake, 3, 1, byte(len(message) >> 8), byte(len(message))}, message...)
+}
+
+func TestPeekClientHello(t *testing.T) {
+	records := recordClientHello(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}})
+	for _, input := range [][]byte{records, fragment(records, 1), fragment(records, 7), fragment(records, 100)} {
+		// Nothing after the ClientHello is consumed
+		reader := bytes.NewReader(append(input, "rest"...))
+		hello, peeked, err := peekClientHello(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "example.com", hello.ServerName)
+		assert.Equal(t, []string{"h2", "http/1.1"}, hello.SupportedProtos)
+		assert.Contains(t, hello.SupportedVersions, uint16(tls.VersionTLS13))
+		assert.Equal(t, input, peeked)
+		rest, _ := io.ReadAll(reader)
+		assert.Equal(t, "rest", string(rest))
+	}
+
+	hello, _, err := peekClientHello(bytes.NewReader(recordClientHello(t, &tls.Config{InsecureSkipVerify: true})))
+	assert.NoError(t, err)
+	assert.Empty(t, hello.ServerName)
+
+	_, _, err = peekClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")))
+	assert.ErrorIs(t, err, errNotClientHello)
+	_, _, err = peekClientHello(bytes.NewReader(records[:len(records)-1]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	// A ClientHello claiming more than maxClientHelloSize is refused after its first record
+	_, _, err = peekClientHello(io.MultiReader(bytes.NewReader([]byte{recordTypeHandshake, 3, 1, 0, 4,
+		handshakeTypeClientHello, 0x10, 0, 0}), neverReader{}))
+	assert.ErrorContains(t, err, "too large")
+}
+
+// neverReader fails the test if a read goes past the data it is placed after.
+type neverReader struct{}
+
+func (neverReader) Read([]byte) (int, error) {
+	return 0, errors.New("read past the client hello")
+}
+
+func TestPeekClientHelloGREASE(t *testing.T) {
+	record := buildClientHello(func(b *cryptobyte.Builder) {
+		// GREASE and ECH extensions are skipped, and the SNI is the public name of the outer ClientHello
+		b.AddUint16(0x1a1a)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+		b.AddUint16(extensionServerName)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("public.example.com")) })
+			})
+		})
+		b.AddUint16(0xfe0d)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(bytes.Repeat([]byte{0xff}, 200)) })
+		b.AddUint16(extensionSupportedVersions)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x3a3a)
+				b.AddUint16(tls.VersionTLS13)
+			})
+		})
+	})
+	hello, _, err := peekClientHello(bytes.NewReader(record))
+	assert.NoError(t, err)
+	assert.Equal(t, "public.example.com", hello.ServerName)
+	assert.Equal(t, []uint16{tls.VersionTLS13}, hello.SupportedVersions)
+	assert.Equal(t, []uint16{tls.TLS_AES_128_GCM_SHA256}, hello.CipherSuites)
+
+	_, _, err = peekClientHello(bytes.NewReader(buildClientHello(func(b *cryptobyte.Builder) {
+		b.AddUint16(extensionALPN)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		})
+	})))
+	assert.ErrorContains(t, err, "extension 16")
+}
+
+func FuzzPeekClientHello(f *testing.F) {
+	records := recordClientHello(f, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2"}})
+	f.Add(records)
+	f.Add(fragment(records, 3))
+	f.Add(buildClientHello(func(b *cryptobyte.Builder) {}))
+	f.Add([]byte{recordTypeHandshake, 3, 1, 0, 4, handshakeTypeClientHello, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, input []byte) {
+		hello, peeked, err := peekClientHello(bytes.NewReader(input))
+		if err != nil {
+			return
+		}
+		assert.NotNil(t, hello)
+		assert.True(t, bytes.HasPrefix(input, peeked))
+		assert.LessOrEqual(t, len(peeked), maxClientHelloSize+(maxClientHelloSize/maxRecordSize+1)*(5+maxRecordSize))
+	})
+}
@@ -0,0 +1,70 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/juzeon/epok-forwarder/data"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// contextDialer is implemented by *net.Dialer and by the dialers wrapping it.
+type contextDialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// outboundDialer dials from the source address and interface configured for a forward.
+type outboundDialer struct {
+	dialer  net.Dialer
+	sources []netip.Addr
+}
+
+func newOutboundDialer(outbound data.Outbound, options data.ForwardTCP) *outboundDialer {
+	o := &outboundDialer{
+		dialer:  net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: options.KeepAlive},
+		sources: outbound.GetSourceAddrs(),
+	}
+	if outbound.BindInterface != "" {
+		o.dialer.Control = bindToInterface(outbound.BindInterface)
+	}
+	return o
+}
+
+func (o *outboundDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if len(o.sources) == 0 {
+		return o.dialer.DialContext(ctx, network, address)
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		// The source depends on the family of the address, so hostnames, e.g. of a proxy, are resolved here
+		host, portStr, splitErr := net.SplitHostPort(address)
+		if splitErr != nil {
+			return nil, splitErr
+		}
+		port, portErr := strconv.Atoi(portStr)
+		if portErr != nil {
+			return nil, err
+		}
+		addrs, lookupErr := net.DefaultResolver.LookupHost(ctx, host)
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return dialAddrs(ctx, o, network, addrs, port)
+	}
+	for _, source := range o.sources {
+		if source.Is4() != addrPort.Addr().Unmap().Is4() {
+			continue
+		}
+		dialer := o.dialer
+		switch network {
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(source, 0))
+		default:
+			dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, 0))
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	// Dialing from an address chosen by the system might leave through the wrong uplink
+	return nil, errors.New("no bind_source address of the same family as " + address)
+}
@@ -0,0 +1,49 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestOutboundDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	dialer := newOutboundDialer(data.Outbound{BindSource: "127.0.0.2,::1"}, data.ForwardTCP{})
+	conn, err := dialer.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String())
+
+	// Hostnames are resolved to an address of the family of a source
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	assert.NoError(t, err)
+	conn, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "127.0.0.2", conn.LocalAddr().(*net.TCPAddr).IP.String())
+
+	dialer = newOutboundDialer(data.Outbound{BindSource: "::1"}, data.ForwardTCP{})
+	_, err = dialer.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.ErrorContains(t, err, "no bind_source address")
+}
+
+func TestOutboundDialerInterface(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("bind_interface is only supported on linux")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	dialer := newOutboundDialer(data.Outbound{BindInterface: "lo"}, data.ForwardTCP{})
+	conn, err := dialer.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.NoError(t, err)
+	conn.Close()
+	dialer = newOutboundDialer(data.Outbound{BindInterface: "no-such-interface"}, data.ForwardTCP{})
+	_, err = dialer.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.Error(t, err)
+}
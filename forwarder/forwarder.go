@@ -59,5 +59,14 @@ func (o *Forwarder) StartAsync() error {
 		o.cancelFunc()
 		return err
 	}
+	data.StartRuleListRefresher(o.ctx, o.config, o.waitGroup)
 	return nil
 }
+func (o *Forwarder) GetUDPFlows() []data.UDPFlow {
+	flows := []data.UDPFlow{}
+	for _, hf := range o.hostForwarders {
+		flows = append(flows, hf.GetUDPFlows()...)
+	}
+	flows = append(flows, o.webForwarder.GetUDPFlows()...)
+	return flows
+}
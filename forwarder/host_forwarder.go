@@ -2,141 +2,409 @@ package forwarder
 
 import (
 	"context"
-	udpForwarder "github.com/1lann/udp-forward"
+	"crypto/tls"
+	"errors"
 	"github.com/juzeon/epok-forwarder/data"
+	"github.com/juzeon/epok-forwarder/util"
+	"github.com/samber/lo"
 	"io"
 	"log/slog"
 	"net"
+	"net/url"
 	"strconv"
 	"sync"
+	"time"
 )
 
+// listenWorkers bounds the number of listeners opened concurrently for a port range.
+const listenWorkers = 64
+
+// forwardTarget holds what every listener of a forward shares.
+type forwardTarget struct {
+	forward       data.Forward
+	firewallArray data.FirewallArray
+	dialer        contextDialer
+	// dial connects to a TCP port of the host once, directly or via the upstream proxy
+	dial data.DialFunc
+	// listenTLS is set if TLS is terminated on the listening side
+	listenTLS *tls.Config
+}
+
 type HostForwarder struct {
 	baseConfig data.BaseConfig
 	hostConfig data.Host
-	dstIP      string
+	resolver   *hostResolver
+	via        *url.URL
 	ctx        context.Context
 	waitGroup  *sync.WaitGroup
+	// mu guards closers and udpRelays, which are appended to concurrently while a port range is set up
+	mu        sync.Mutex
+	closers   []io.Closer
+	udpRelays []*udpRelay
 }
 
 func NewHostForwarder(ctx context.Context, baseConfig data.BaseConfig, hostConfig data.Host,
 	webForwarder *WebForwarder, waitGroup *sync.WaitGroup) (*HostForwarder, error) {
-	addr, err := net.LookupHost(hostConfig.Host)
+	via, err := hostConfig.GetVia()
 	if err != nil {
 		return nil, err
 	}
 	hf := &HostForwarder{
 		baseConfig: baseConfig,
 		hostConfig: hostConfig,
-		dstIP:      addr[0],
+		resolver:   newHostResolver(hostConfig.Host, baseConfig.ResolveTTL),
+		via:        via,
 		ctx:        ctx,
 		waitGroup:  waitGroup,
 	}
+	if via != nil {
+		slog.Info("Dial host via proxy", "host", hostConfig.Host, "via", via.Redacted())
+	} else if _, err := hf.resolver.Resolve(ctx); err != nil {
+		if !hostConfig.DeferResolve {
+			return nil, err
+		}
+		slog.Warn("Cannot resolve host, retry on first connection", "host", hostConfig.Host, "err", err)
+	}
+	hf.closeOnDoneAsync()
 	for _, forward := range hostConfig.Forwards {
 		forward := forward
-		firewallArray := data.FirewallArray{
-			baseConfig.Firewall,
-			hostConfig.Firewall,
-			forward.Firewall,
+		dialer := newOutboundDialer(forward.Outbound, forward.ForwardTCP)
+		listenTLS, err := forward.ForwardTLS.GetListenConfig()
+		if err != nil {
+			return nil, err
+		}
+		backendTLS, err := forward.ForwardTLS.GetBackendConfig(hostConfig.Host)
+		if err != nil {
+			return nil, err
+		}
+		target := &forwardTarget{
+			forward: forward,
+			firewallArray: data.FirewallArray{
+				baseConfig.Firewall,
+				hostConfig.Firewall,
+				forward.Firewall,
+			},
+			dialer:    dialer,
+			dial:      hf.newTCPDial(dialer, forward.ForwardTCP),
+			listenTLS: listenTLS,
+		}
+		dial := target.dial
+		if backendTLS != nil {
+			target.dial = withBackendTLS(dial, backendTLS, forward.ConnectTimeout)
 		}
 		switch forward.Type {
 		case data.ForwardTypePort:
-			if err = hf.forwardTCPAsync(forward.ForwardPort.Src, forward.ForwardPort.Dst, firewallArray); err != nil {
-				return nil, err
+			slog.Info("Register port forwarder", "src-port", forward.ForwardPort.Src,
+				"dst-port", forward.ForwardPort.Dst, "dst-host", hostConfig.Host, "protocol", forward.Protocol)
+			if forward.HasTCP() {
+				if err := hf.forwardTCPAsync(target, forward.ForwardPort.Src, forward.ForwardPort.Dst,
+					nil); err != nil {
+					return nil, err
+				}
 			}
-			if !forward.DisableUDP {
-				if err = hf.forwardUDPAsync(forward.ForwardPort.Src, forward.ForwardPort.Dst); err != nil {
+			if forward.HasUDP() {
+				if err := hf.forwardUDPAsync(target, forward.ForwardPort.Src, forward.ForwardPort.Dst,
+					nil); err != nil {
 					return nil, err
 				}
 			}
 		case data.ForwardTypePortRange:
-			ports, err := forward.ForwardPortRange.GetPorts()
+			mappings, err := forward.GetPortMappings()
 			if err != nil {
 				return nil, err
 			}
-			for _, port := range ports {
-				if err = hf.forwardTCPAsync(port, port, firewallArray); err != nil {
+			slog.Info("Register port range forwarder", "ports", string(forward.ForwardPortRange),
+				"count", len(mappings), "dst-ports", string(forward.DstRange), "offset", forward.Offset,
+				"dst-host", hostConfig.Host, "protocol", forward.Protocol, "tproxy", forward.TProxy)
+			if forward.HasTCP() && forward.TProxy != 0 {
+				dstPorts := lo.SliceToMap(mappings, func(item data.PortMapping) (int, int) {
+					return item.Src, item.Dst
+				})
+				if err = hf.forwardTProxyAsync(target, func(port int) (int, bool) {
+					dstPort, ok := dstPorts[port]
+					return dstPort, ok
+				}); err != nil {
 					return nil, err
 				}
-				if !forward.DisableUDP {
-					if err = hf.forwardUDPAsync(port, port); err != nil {
-						return nil, err
+			}
+			var p *poller
+			if forward.HasUDP() || forward.HasTCP() && forward.TProxy == 0 {
+				if p, err = hf.startPoller(); err != nil {
+					return nil, err
+				}
+			}
+			err = util.RunParallel(len(mappings), listenWorkers, func(i int) error {
+				mapping := mappings[i]
+				if forward.HasTCP() && forward.TProxy == 0 {
+					if err := hf.forwardTCPAsync(target, mapping.Src, mapping.Dst, p); err != nil {
+						return err
 					}
 				}
+				if forward.HasUDP() {
+					return hf.forwardUDPAsync(target, mapping.Src, mapping.Dst, p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		case data.ForwardTypeSOCKS5:
+			slog.Info("Register socks5 forwarder", "src-port", forward.ForwardPort.Src,
+				"destinations", string(forward.Destinations), "users", len(forward.Users))
+			if err := hf.forwardProxyAsync(target, hf.serveSOCKS5); err != nil {
+				return nil, err
+			}
+		case data.ForwardTypeHTTPProxy:
+			slog.Info("Register http proxy forwarder", "src-port", forward.ForwardPort.Src,
+				"destinations", string(forward.Destinations), "users", len(forward.Users))
+			if err := hf.forwardProxyAsync(target, hf.serveHTTPProxy); err != nil {
+				return nil, err
 			}
 		case data.ForwardTypeWeb:
-			for _, hostname := range forward.ForwardWeb.Hostnames {
-				webForwarder.RegisterTarget(hostname, hf.dstIP, forward.ForwardWeb.Http, forward.ForwardWeb.Https,
-					firewallArray)
+			hostnames := forward.ForwardWeb.Hostnames
+			if len(hostnames) == 0 {
+				// A default forward without hostnames only receives clients without SNI
+				hostnames = []string{""}
+			}
+			for _, hostname := range hostnames {
+				webForwarder.RegisterTarget(data.WebForwardTarget{
+					Hostname:     hostname,
+					ListenPort:   forward.ForwardWeb.Listen,
+					ALPN:         forward.ForwardWeb.GetALPN(),
+					Default:      forward.ForwardWeb.Default,
+					DstHost:      hostConfig.Host,
+					DstHttpPort:  forward.ForwardWeb.Http,
+					DstHttpsPort: forward.ForwardWeb.Https,
+					Dial: func(ctx context.Context, port int) (net.Conn, error) {
+						// backend_tls only applies to the https port
+						return dialTCP(ctx, lo.Ternary(port == forward.ForwardWeb.Https, target.dial, dial), port,
+							forward.ForwardTCP)
+					},
+					DialUDP:       hf.newUDPDial(dialer),
+					TCPOptions:    forward.ForwardTCP,
+					UDPOptions:    forward.ForwardUDP,
+					FirewallArray: target.firewallArray,
+					TLSConfig:     target.listenTLS,
+				})
 			}
 		}
 	}
+	hf.expireUDPSessionsAsync()
 	return hf, nil
 }
-func (o *HostForwarder) forwardUDPAsync(srcPort int, dstPort int) error {
-	slog.Info("Register udp forwarder", "src-port", srcPort, "dst-port", dstPort, "dst-ip", o.dstIP)
-	f, err := udpForwarder.Forward(":"+strconv.Itoa(srcPort), o.dstIP+":"+strconv.Itoa(dstPort),
-		udpForwarder.DefaultTimeout)
-	if err != nil {
-		return err
+
+func (o *HostForwarder) newTCPDial(dialer contextDialer, options data.ForwardTCP) data.DialFunc {
+	if o.via == nil {
+		return func(ctx context.Context, port int) (net.Conn, error) {
+			return o.resolver.DialContext(ctx, dialer, "tcp", port)
+		}
+	}
+	proxy := &proxyDialer{proxy: o.via, dialer: dialer, timeout: options.ConnectTimeout}
+	return func(ctx context.Context, port int) (net.Conn, error) {
+		return proxy.DialContext(ctx, "tcp", net.JoinHostPort(o.hostConfig.Host, strconv.Itoa(port)))
 	}
+}
+
+// newUDPDial returns a DialFunc of UDP sockets to the host, or nil if the host is behind a proxy.
+func (o *HostForwarder) newUDPDial(dialer contextDialer) data.DialFunc {
+	if o.via != nil {
+		return nil
+	}
+	return func(ctx context.Context, port int) (net.Conn, error) {
+		return o.resolver.DialContext(ctx, dialer, "udp", port)
+	}
+}
+
+// closeOnDoneAsync closes every listener of the host once the context is done, with a single goroutine for all of
+// them.
+func (o *HostForwarder) closeOnDoneAsync() {
 	o.waitGroup.Add(1)
 	go func() {
+		defer o.waitGroup.Done()
 		<-o.ctx.Done()
-		f.Close()
-		slog.Info("Close udp listener", "src-port", srcPort, "dst-port", dstPort, "dst-ip", o.dstIP)
-		o.waitGroup.Done()
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		for _, closer := range o.closers {
+			closer.Close()
+		}
+		slog.Info("Close host listeners", "count", len(o.closers), "dst-host", o.hostConfig.Host)
 	}()
-	return nil
 }
-func (o *HostForwarder) forwardTCPAsync(srcPort int, dstPort int, firewallArray data.FirewallArray) error {
-	slog.Info("Register tcp forwarder", "src-port", srcPort, "dst-port", dstPort, "dst-ip", o.dstIP)
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(srcPort))
+func (o *HostForwarder) addCloser(closer io.Closer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	select {
+	case <-o.ctx.Done():
+		closer.Close()
+	default:
+		o.closers = append(o.closers, closer)
+	}
+}
+
+// startPoller starts a poller that serves the sockets of a port range from a single goroutine. It returns nil if
+// pollers are not supported, and the sockets are then served by a goroutine each.
+func (o *HostForwarder) startPoller() (*poller, error) {
+	p, err := newPoller()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 	o.waitGroup.Add(1)
 	go func() {
-		<-o.ctx.Done()
-		l.Close()
-		slog.Info("Close tcp listener", "src-port", srcPort, "dst-port", dstPort, "dst-ip", o.dstIP)
-		o.waitGroup.Done()
+		defer o.waitGroup.Done()
+		p.run()
 	}()
+	o.addCloser(p)
+	return p, nil
+}
+
+// expireUDPSessionsAsync drops idle UDP sessions of all relays of the host from a single goroutine.
+func (o *HostForwarder) expireUDPSessionsAsync() {
+	if len(o.udpRelays) == 0 {
+		return
+	}
+	interval := lo.MinBy(o.udpRelays, func(a *udpRelay, b *udpRelay) bool {
+		return a.options.UDPTimeout < b.options.UDPTimeout
+	}).options.UDPTimeout / 2
+	o.waitGroup.Add(1)
 	go func() {
-		defer l.Close()
-		defer slog.Info("Close tcp listener", "src-port", srcPort, "dst-port", dstPort, "dst-ip", o.dstIP)
+		defer o.waitGroup.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 		for {
-			acceptedConn, err := l.Accept()
-			if err != nil {
-				slog.Warn("Cannot accept conn", "error", err)
-				break
+			select {
+			case <-o.ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, relay := range o.udpRelays {
+					relay.expireSessions(now)
+				}
 			}
-			allow, reason := firewallArray.CheckAllowByAddr(acceptedConn.RemoteAddr().String())
-			if !allow {
-				slog.Warn("Deny conn", "reason", reason)
-				acceptedConn.Close()
-				continue
+		}
+	}()
+}
+
+// forwardUDPAsync relays UDP of srcPort to dstPort of the host. The sockets are served by p unless it is nil.
+func (o *HostForwarder) forwardUDPAsync(target *forwardTarget, srcPort int, dstPort int, p *poller) error {
+	for _, listenAddr := range target.forward.Bind.GetListenAddrs("udp", srcPort) {
+		addr, err := net.ResolveUDPAddr(listenAddr.Network, listenAddr.Address)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP(listenAddr.Network, addr)
+		if err != nil {
+			return err
+		}
+		o.addCloser(conn)
+		relay := newUDPRelay(o.ctx, conn, o.resolver, target.dialer, dstPort, target.firewallArray,
+			target.forward.ForwardUDP)
+		o.mu.Lock()
+		o.udpRelays = append(o.udpRelays, relay)
+		o.mu.Unlock()
+		if p != nil {
+			if err := p.addUDPRelay(relay); err != nil {
+				return err
 			}
-			slog.Info("Accept connection", "addr", l.Addr().String(), "reason", reason)
-			dialedConn, err := (&net.Dialer{}).DialContext(o.ctx, "tcp",
-				net.JoinHostPort(o.dstIP, strconv.Itoa(dstPort)))
-			if err != nil {
-				slog.Warn("Cannot dial tcp", "error", err)
-				acceptedConn.Close()
-				continue
+			continue
+		}
+		go relay.Serve()
+	}
+	return nil
+}
+
+// forwardTCPAsync relays TCP of srcPort to dstPort of the host. The listeners are served by p unless it is nil.
+func (o *HostForwarder) forwardTCPAsync(target *forwardTarget, srcPort int, dstPort int, p *poller) error {
+	for _, listenAddr := range target.forward.Bind.GetListenAddrs("tcp", srcPort) {
+		l, err := net.Listen(listenAddr.Network, listenAddr.Address)
+		if err != nil {
+			return err
+		}
+		o.addCloser(l)
+		handle := func(conn net.Conn) {
+			o.handleTCPConn(conn, func(port int) (int, bool) { return dstPort, true }, target)
+		}
+		if p != nil {
+			if err := p.addListener(l, handle); err != nil {
+				return err
 			}
-			slog.Info("Dial connection", "addr", net.JoinHostPort(o.dstIP, strconv.Itoa(dstPort)))
-			go func() {
-				defer acceptedConn.Close()
-				defer dialedConn.Close()
-				io.Copy(acceptedConn, dialedConn)
-			}()
-			go func() {
-				defer acceptedConn.Close()
-				defer dialedConn.Close()
-				io.Copy(dialedConn, acceptedConn)
-			}()
+			continue
 		}
-	}()
+		go o.serve(l, handle)
+	}
 	return nil
 }
+
+// forwardTProxyAsync accepts the connections of a whole port range on a single transparent socket. The original
+// destination port of each connection is mapped to the port to dial by getDstPort.
+func (o *HostForwarder) forwardTProxyAsync(target *forwardTarget, getDstPort func(port int) (int, bool)) error {
+	for _, listenAddr := range target.forward.Bind.GetListenAddrs("tcp", target.forward.TProxy) {
+		l, err := listenTransparent(listenAddr.Network, listenAddr.Address)
+		if err != nil {
+			return err
+		}
+		o.addCloser(l)
+		go o.serve(l, func(conn net.Conn) { o.handleTCPConn(conn, getDstPort, target) })
+	}
+	return nil
+}
+
+// serve accepts connections until the listener is closed, and handles each of them in a new goroutine.
+func (o *HostForwarder) serve(l net.Listener, handle func(conn net.Conn)) {
+	for {
+		acceptedConn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Cannot accept conn", "error", err)
+			}
+			break
+		}
+		go handle(acceptedConn)
+	}
+}
+
+// handleTCPConn relays a connection to the host. getDstPort maps the local port the connection arrived on to the
+// port to dial, or reports false to reject it.
+func (o *HostForwarder) handleTCPConn(acceptedConn net.Conn, getDstPort func(port int) (int, bool),
+	target *forwardTarget) {
+	dstPort, ok := getDstPort(acceptedConn.LocalAddr().(*net.TCPAddr).Port)
+	if !ok {
+		slog.Warn("Deny conn to unknown port", "addr", acceptedConn.LocalAddr().String())
+		acceptedConn.Close()
+		return
+	}
+	allow, reason := target.firewallArray.CheckAllowByAddr(acceptedConn.RemoteAddr().String())
+	if !allow {
+		slog.Warn("Deny conn", "reason", reason)
+		acceptedConn.Close()
+		return
+	}
+	options := target.forward.ForwardTCP
+	setTCPOptions(acceptedConn, options)
+	if target.listenTLS != nil {
+		tlsConn, err := acceptTLS(o.ctx, acceptedConn, target.listenTLS)
+		if err != nil {
+			slog.Warn("Cannot accept tls conn", "client", acceptedConn.RemoteAddr().String(), "error", err)
+			acceptedConn.Close()
+			return
+		}
+		acceptedConn = tlsConn
+	}
+	slog.Info("Accept connection", "addr", acceptedConn.LocalAddr().String(), "reason", reason)
+	dialedConn, err := dialTCP(o.ctx, target.dial, dstPort, options)
+	if err != nil {
+		slog.Warn("Cannot dial tcp", "error", err)
+		acceptedConn.Close()
+		return
+	}
+	slog.Info("Dial connection", "addr", dialedConn.RemoteAddr().String())
+	relayTCP(acceptedConn, nil, dialedConn, options.IdleTimeout)
+}
+func (o *HostForwarder) GetUDPFlows() []data.UDPFlow {
+	var flows []data.UDPFlow
+	for _, relay := range o.udpRelays {
+		flows = append(flows, relay.GetFlows()...)
+	}
+	return flows
+}
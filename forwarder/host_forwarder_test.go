@@ -0,0 +1,196 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// serveUntilEOF answers every connection accepted from l with "got:" and everything read from it, once the client
+// has half-closed its side.
+func serveUntilEOF(t testing.TB, l net.Listener) {
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte("got:"), b...))
+			}()
+		}
+	}()
+}
+
+func TestHostForwarderHalfClose(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	forward := data.Forward{
+		Type:        data.ForwardTypePort,
+		Protocol:    data.ProtocolTCP,
+		Bind:        "127.0.0.1",
+		ForwardPort: data.ForwardPort{Src: freePort(t), Dst: backend.Addr().(*net.TCPAddr).Port},
+	}
+	assert.NoError(t, forward.Validate())
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	defer waitGroup.Wait()
+	defer cancel()
+	_, err = NewHostForwarder(ctx, data.BaseConfig{}, data.Host{Host: "127.0.0.1", Forwards: []data.Forward{forward}},
+		nil, waitGroup)
+	assert.NoError(t, err)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(forward.ForwardPort.Src)))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", string(reply))
+}
+
+func TestHostForwarderPortRange(t *testing.T) {
+	newForward := func(protocol string, dstPorts ...int) data.Forward {
+		srcPorts := []int{freePort(t), freePort(t)}
+		forward := data.Forward{
+			Type:     data.ForwardTypePortRange,
+			Protocol: protocol,
+			Bind:     "127.0.0.1",
+			ForwardPortRange: data.ForwardPortRange(strconv.Itoa(srcPorts[0]) + "," +
+				strconv.Itoa(srcPorts[1])),
+			DstRange: data.ForwardPortRange(strconv.Itoa(dstPorts[0]) + "," + strconv.Itoa(dstPorts[1])),
+		}
+		assert.NoError(t, forward.Validate())
+		return forward
+	}
+	var tcpPorts, udpPorts []int
+	for i := 0; i < 2; i++ {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		serveUntilEOF(t, backend)
+		tcpPorts = append(tcpPorts, backend.Addr().(*net.TCPAddr).Port)
+		echo := startUDPEcho(t)
+		udpPorts = append(udpPorts, echo.LocalAddr().(*net.UDPAddr).Port)
+	}
+	tcpForward := newForward(data.ProtocolTCP, tcpPorts...)
+	udpForward := newForward(data.ProtocolUDP, udpPorts...)
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	hf, err := NewHostForwarder(ctx, data.BaseConfig{}, data.Host{Host: "127.0.0.1",
+		Forwards: []data.Forward{tcpForward, udpForward}}, nil, waitGroup)
+	assert.NoError(t, err)
+	tcpMappings, err := tcpForward.GetPortMappings()
+	assert.NoError(t, err)
+	for _, mapping := range tcpMappings {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(mapping.Src)))
+		assert.NoError(t, err)
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		reply, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "got:ping", string(reply))
+		conn.Close()
+	}
+	udpMappings, err := udpForward.GetPortMappings()
+	assert.NoError(t, err)
+	for _, mapping := range udpMappings {
+		reply, err := exchangeUDP(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: mapping.Src}, "hello")
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", reply)
+	}
+	assert.Len(t, hf.GetUDPFlows(), 2)
+	cancel()
+	waitGroup.Wait()
+	// The sessions are closed along with the listening sockets
+	assert.Len(t, hf.GetUDPFlows(), 0)
+	_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tcpMappings[0].Src)))
+	assert.Error(t, err)
+}
+
+// BenchmarkPortRange reports the startup time, memory and goroutines of a port range. Every port needs a socket for
+// each protocol, except for TCP in tproxy mode, so the sizes need a file descriptor limit above 10000.
+func BenchmarkPortRange(b *testing.B) {
+	for _, c := range []struct {
+		protocol string
+		tproxy   int
+		size     int
+	}{
+		{data.ProtocolTCP, 0, 1000},
+		{data.ProtocolTCP, 0, 10000},
+		{data.ProtocolUDP, 0, 1000},
+		{data.ProtocolUDP, 0, 10000},
+		{data.ProtocolTCP, freePort(b), 10000},
+	} {
+		name := c.protocol + "/" + strconv.Itoa(c.size)
+		if c.tproxy != 0 {
+			name = "tproxy/" + strconv.Itoa(c.size)
+		}
+		b.Run(name, func(b *testing.B) {
+			if c.tproxy != 0 {
+				l, err := listenTransparent("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(c.tproxy)))
+				if err != nil {
+					b.Skip("Cannot listen transparently:", err)
+				}
+				l.Close()
+			}
+			host := data.Host{
+				Host: "127.0.0.1",
+				Forwards: []data.Forward{{
+					Type:             data.ForwardTypePortRange,
+					Protocol:         c.protocol,
+					Bind:             "127.0.0.1",
+					ForwardPortRange: data.ForwardPortRange("20000-" + strconv.Itoa(20000+c.size-1)),
+					TProxy:           c.tproxy,
+					ForwardUDP:       data.ForwardUDP{UDPTimeout: time.Minute},
+				}},
+			}
+			var startup time.Duration
+			var memory, goroutines float64
+			for i := 0; i < b.N; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				waitGroup := &sync.WaitGroup{}
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				goroutinesBefore := runtime.NumGoroutine()
+				start := time.Now()
+				_, err := NewHostForwarder(ctx, data.BaseConfig{}, host, nil, waitGroup)
+				startup += time.Since(start)
+				assert.NoError(b, err)
+				time.Sleep(100 * time.Millisecond) // let the serving goroutines park
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				memory += float64(after.HeapInuse+after.StackInuse) - float64(before.HeapInuse+before.StackInuse)
+				goroutines += float64(runtime.NumGoroutine() - goroutinesBefore)
+				cancel()
+				waitGroup.Wait()
+			}
+			b.ReportMetric(float64(startup.Milliseconds())/float64(b.N), "startup-ms/op")
+			b.ReportMetric(memory/float64(b.N)/1024/1024, "MiB/op")
+			b.ReportMetric(goroutines/float64(b.N), "goroutines/op")
+		})
+	}
+}
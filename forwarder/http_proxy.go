@@ -0,0 +1,116 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/samber/lo"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// serveHTTPProxy serves HTTP CONNECT tunnels and plain proxy requests with absolute URLs from l until it is closed.
+func (o *HostForwarder) serveHTTPProxy(l net.Listener, target *proxyTarget) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Requests must only leave through the allowlist of the forward, never through a proxy from the environment
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return o.dialDestination(ctx, target, addr)
+	}
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(request *httputil.ProxyRequest) {
+			request.Out.URL = request.In.URL
+			request.Out.Host = request.In.Host
+		},
+		Transport: transport,
+		ErrorHandler: func(writer http.ResponseWriter, request *http.Request, err error) {
+			slog.Warn("Cannot proxy http request", "client", request.RemoteAddr, "dst", request.URL.Host,
+				"error", err)
+			writer.WriteHeader(lo.Ternary(errors.Is(err, errDestinationNotAllowed), http.StatusForbidden,
+				http.StatusBadGateway))
+		},
+	}
+	server := &http.Server{
+		ReadHeaderTimeout: proxyHandshakeTimeout,
+		IdleTimeout:       120 * time.Second,
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			allow, reason := target.firewallArray.CheckAllowByAddr(request.RemoteAddr)
+			if !allow {
+				slog.Warn("Deny http proxy conn", "reason", reason)
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			user, ok := checkProxyAuthorization(request, target.forward.Users)
+			if !ok {
+				slog.Warn("Cannot authenticate http proxy conn", "client", request.RemoteAddr, "user", user)
+				writer.Header().Set("Proxy-Authenticate", `Basic realm="epok"`)
+				writer.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+			if request.Method == http.MethodConnect {
+				slog.Info("Proxy http connect", "client", request.RemoteAddr, "user", user, "dst", request.Host,
+					"reason", reason)
+				o.handleHTTPConnect(writer, request, target)
+				return
+			}
+			if !request.URL.IsAbs() || request.URL.Scheme != "http" {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			slog.Info("Proxy http request", "client", request.RemoteAddr, "user", user, "dst", request.URL.Host,
+				"reason", reason)
+			reverseProxy.ServeHTTP(writer, request)
+		}),
+		BaseContext: func(listener net.Listener) context.Context {
+			return o.ctx
+		},
+	}
+	if err := server.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		slog.Warn("Cannot serve http proxy", "error", err)
+	}
+}
+
+// checkProxyAuthorization checks the basic credentials of a proxy request, which are not needed without users.
+func checkProxyAuthorization(request *http.Request, users map[string]string) (string, bool) {
+	if len(users) == 0 {
+		return "", true
+	}
+	// http.Request.BasicAuth only reads the Authorization header, so parse the proxy one the same way
+	username, password, ok := (&http.Request{Header: http.Header{
+		"Authorization": request.Header.Values("Proxy-Authorization"),
+	}}).BasicAuth()
+	if !ok {
+		return "", false
+	}
+	return username, checkUser(users, username, password)
+}
+
+func (o *HostForwarder) handleHTTPConnect(writer http.ResponseWriter, request *http.Request, target *proxyTarget) {
+	dialedConn, err := o.dialDestination(request.Context(), target, request.Host)
+	if err != nil {
+		slog.Warn("Cannot proxy http connect", "client", request.RemoteAddr, "dst", request.Host, "error", err)
+		writer.WriteHeader(lo.Ternary(errors.Is(err, errDestinationNotAllowed), http.StatusForbidden,
+			http.StatusBadGateway))
+		return
+	}
+	clientConn, buffered, err := http.NewResponseController(writer).Hijack()
+	if err != nil {
+		slog.Warn("Cannot hijack http connect", "error", err)
+		dialedConn.Close()
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	clientConn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		clientConn.Close()
+		dialedConn.Close()
+		return
+	}
+	// The client may have sent data right after the request, which is already buffered by the server
+	peeked, _ := buffered.Reader.Peek(buffered.Reader.Buffered())
+	setTCPOptions(clientConn, target.forward.ForwardTCP)
+	relayTCP(clientConn, peeked, dialedConn, target.forward.IdleTimeout)
+}
@@ -0,0 +1,159 @@
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/samber/lo"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	protocolTLS     = "tls"
+	protocolHTTP    = "http"
+	protocolSSH     = "ssh"
+	protocolUnknown = "unknown"
+)
+
+// muxDialTimeout bounds dialing the ssh and fallback backends of mux.
+const muxDialTimeout = 10 * time.Second
+
+// httpMethods are the request lines plain HTTP clients start with, including the HTTP/2 connection preface.
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "CONNECT ", "OPTIONS ", "TRACE ", "PATCH ",
+	"PRI "}
+
+// sniffProtocol reads the first bytes of reader until they tell TLS, plain HTTP, SSH or another protocol apart, and
+// returns the protocol along with the bytes read. On a read error, the protocol is unknown.
+func sniffProtocol(reader io.Reader) (string, []byte, error) {
+	buf := make([]byte, 0, 16)
+	for {
+		if protocol, ok := matchProtocol(buf); ok {
+			return protocol, buf, nil
+		}
+		n, err := reader.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			return protocolUnknown, buf, err
+		}
+	}
+}
+
+// matchProtocol reports the protocol starting with prefix, or false if more bytes are needed to tell.
+func matchProtocol(prefix []byte) (string, bool) {
+	if len(prefix) == 0 {
+		return "", false
+	}
+	if prefix[0] == recordTypeHandshake {
+		return protocolTLS, true
+	}
+	undecided := false
+	for _, candidate := range append([]string{"SSH-"}, httpMethods...) {
+		if bytes.HasPrefix(prefix, []byte(candidate)) {
+			return lo.Ternary(candidate == "SSH-", protocolSSH, protocolHTTP), true
+		}
+		undecided = undecided || bytes.HasPrefix([]byte(candidate), prefix)
+	}
+	if undecided {
+		return "", false
+	}
+	return protocolUnknown, true
+}
+
+// handleMuxConn detects the protocol of a client accepted on port and dispatches it: TLS by SNI as on the https
+// port if accepted on the http port, plain HTTP by Host, SSH to mux.ssh, and anything else, including clients that
+// send nothing in time, to mux.fallback.
+func (o *WebForwarder) handleMuxConn(clientConn net.Conn, port int) {
+	if err := clientConn.SetReadDeadline(time.Now().Add(o.baseConfig.ClientHelloTimeout)); err != nil {
+		slog.Warn("Cannot set read deadline", "err", err)
+		clientConn.Close()
+		return
+	}
+	protocol, sniffed, err := sniffProtocol(clientConn)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		slog.Warn("Cannot sniff protocol", "client", clientConn.RemoteAddr().String(), "err", err)
+		clientConn.Close()
+		return
+	}
+	if err := clientConn.SetReadDeadline(time.Time{}); err != nil {
+		slog.Warn("Cannot set read deadline", "err", err)
+		clientConn.Close()
+		return
+	}
+	switch protocol {
+	case protocolTLS:
+		o.handleTLSConn(clientConn, sniffed, lo.Ternary(port == o.baseConfig.Http, o.baseConfig.Https, port))
+	case protocolHTTP:
+		o.muxHttp.push(&prefixConn{Conn: clientConn, prefix: sniffed})
+	case protocolSSH:
+		o.relayMux(clientConn, sniffed, protocol, o.baseConfig.Mux.SSH)
+	default:
+		o.relayMux(clientConn, sniffed, protocol, o.baseConfig.Mux.Fallback)
+	}
+}
+
+// relayMux relays a client detected by handleMuxConn to backend, or closes it if there is no backend for protocol.
+func (o *WebForwarder) relayMux(clientConn net.Conn, sniffed []byte, protocol string, backend string) {
+	if backend == "" {
+		slog.Warn("No mux backend", "protocol", protocol, "client", clientConn.RemoteAddr().String())
+		clientConn.Close()
+		return
+	}
+	allow, reason := data.FirewallArray{o.baseConfig.Firewall}.CheckAllowByAddr(clientConn.RemoteAddr().String())
+	if !allow {
+		slog.Warn("Deny mux conn", "protocol", protocol, "reason", reason)
+		clientConn.Close()
+		return
+	}
+	dialer := net.Dialer{Timeout: muxDialTimeout}
+	backendConn, err := dialer.DialContext(o.ctx, "tcp", backend)
+	if err != nil {
+		slog.Warn("Cannot dial backend", "dest", backend, "err", err)
+		clientConn.Close()
+		return
+	}
+	slog.Info("Serve mux", "protocol", protocol, "dest", backend, "reason", reason)
+	relayTCP(clientConn, sniffed, backendConn, 0)
+}
+
+// connListener is a net.Listener accepting the connections handed over by push, so that an http.Server can serve
+// connections accepted and sniffed elsewhere.
+type connListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (o *connListener) push(conn net.Conn) {
+	select {
+	case o.conns <- conn:
+	case <-o.done:
+		conn.Close()
+	}
+}
+
+func (o *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-o.conns:
+		return conn, nil
+	case <-o.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (o *connListener) Close() error {
+	o.closeOnce.Do(func() { close(o.done) })
+	return nil
+}
+
+func (o *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
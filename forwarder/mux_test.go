@@ -0,0 +1,132 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	for _, c := range []struct {
+		input    string
+		protocol string
+		sniffed  string
+	}{
+		{"\x16\x03\x01\x00", protocolTLS, "\x16"},
+		{"GET / HTTP/1.1\r\n", protocolHTTP, "GET "},
+		{"PUT /a HTTP/1.1\r\n", protocolHTTP, "PUT "},
+		{"PRI * HTTP/2.0\r\n", protocolHTTP, "PRI "},
+		{"SSH-2.0-OpenSSH_9.6\r\n", protocolSSH, "SSH-"},
+		{"GETX", protocolUnknown, "GETX"},
+		{"\x00\x01", protocolUnknown, "\x00"},
+	} {
+		// Read one byte at a time to check that the protocol is told as early as possible
+		protocol, sniffed, err := sniffProtocol(io.LimitReader(&byteReader{data: []byte(c.input)}, 64))
+		assert.NoError(t, err, c.input)
+		assert.Equal(t, c.protocol, protocol, c.input)
+		assert.Equal(t, c.sniffed, string(sniffed), c.input)
+	}
+	protocol, sniffed, err := sniffProtocol(bytes.NewReader([]byte("GE")))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, protocolUnknown, protocol)
+	assert.Equal(t, "GE", string(sniffed))
+}
+
+// byteReader returns data one byte per read.
+type byteReader struct {
+	data []byte
+}
+
+func (o *byteReader) Read(b []byte) (int, error) {
+	if len(o.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b[:1], o.data)
+	o.data = o.data[n:]
+	return n, nil
+}
+
+func TestWebForwarderMux(t *testing.T) {
+	httpBackend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { httpBackend.Close() })
+	go http.Serve(httpBackend, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte("http:" + request.Host))
+	}))
+	httpsBackend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "example.com")},
+	})
+	assert.NoError(t, err)
+	serveUntilEOF(t, httpsBackend)
+	sshBackend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, sshBackend)
+	fallback, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { fallback.Close() })
+	go func() {
+		for {
+			conn, err := fallback.Accept()
+			if err != nil {
+				return
+			}
+			// A server-speaks-first protocol
+			conn.Write([]byte("220 fallback\r\n"))
+			conn.Close()
+		}
+	}()
+	httpAddr, httpsAddr := serveWebForwarder(t, data.BaseConfig{
+		ClientHelloTimeout: 200 * time.Millisecond,
+		Mux: data.Mux{
+			Enable:   true,
+			SSH:      sshBackend.Addr().String(),
+			Fallback: fallback.Addr().String(),
+		},
+	}, data.WebForwardTarget{
+		Hostname:     "example.com",
+		DstHttpPort:  httpBackend.Addr().(*net.TCPAddr).Port,
+		DstHttpsPort: httpsBackend.Addr().(*net.TCPAddr).Port,
+	})
+	// exchange sends request to addr, half-closing unless it is plain http, and returns the reply
+	exchange := func(addr string, request string) string {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+		if request != "" {
+			_, err = conn.Write([]byte(request))
+			assert.NoError(t, err)
+		}
+		if request != "" && !bytes.HasPrefix([]byte(request), []byte("GET ")) {
+			// An http.Server cancels the request of a client that half-closes
+			assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		}
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+	for _, addr := range []string{httpAddr, httpsAddr} {
+		// Plain http on either port is routed by Host
+		reply := exchange(addr, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+		assert.Contains(t, reply, "http:example.com")
+		// TLS on either port is routed by SNI
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		_, err = tlsConn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		assert.NoError(t, tlsConn.CloseWrite())
+		assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		tlsReply, err := io.ReadAll(tlsConn)
+		assert.NoError(t, err)
+		assert.Equal(t, "got:ping", string(tlsReply))
+		conn.Close()
+		assert.Equal(t, "got:SSH-2.0-test\r\n", exchange(addr, "SSH-2.0-test\r\n"))
+		// A client that sends nothing goes to the fallback once client_hello_timeout expires
+		assert.Equal(t, "220 fallback\r\n", exchange(addr, ""))
+	}
+}
@@ -0,0 +1,205 @@
+package forwarder
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// pollerEvents bounds the events taken from epoll at once
+	pollerEvents = 128
+	// maxReadsPerEvent bounds the packets or connections taken from a socket per event, so that a busy port
+	// doesn't hold up the others. Epoll is level-triggered, so the rest is taken on the next round.
+	maxReadsPerEvent = 64
+	// pollerErrorBackoff is how long the poller pauses after a socket fails for another reason than being closed,
+	// such as running out of file descriptors, since the socket stays readable
+	pollerErrorBackoff = 50 * time.Millisecond
+)
+
+type pollerSocket struct {
+	rawConn syscall.RawConn
+	// read takes what is queued on fd without waiting
+	read func(fd int) error
+	// onClose is called once the socket is closed or the poller stops
+	onClose func()
+}
+
+// poller waits for the sockets of a port range to become readable with a single epoll instance and goroutine, so
+// that idle ports don't each park a goroutine in accept or read.
+type poller struct {
+	epfd int
+	// wakeFd is an eventfd that stops run once written to
+	wakeFd int
+	// mu guards sockets, which are added concurrently while a port range is set up, and stopped
+	mu      sync.Mutex
+	sockets map[int32]*pollerSocket
+	// stopped is set once run has closed epfd and wakeFd
+	stopped bool
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, os.NewSyscallError("eventfd", err)
+	}
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wakeFd)})
+	if err != nil {
+		unix.Close(epfd)
+		unix.Close(wakeFd)
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+	return &poller{epfd: epfd, wakeFd: wakeFd, sockets: map[int32]*pollerSocket{}}, nil
+}
+
+func (o *poller) add(conn syscall.Conn, read func(fd int) error, onClose func()) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ctlErr error
+	err = rawConn.Control(func(fd uintptr) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.sockets[int32(fd)] = &pollerSocket{rawConn: rawConn, read: read, onClose: onClose}
+		ctlErr = unix.EpollCtl(o.epfd, unix.EPOLL_CTL_ADD, int(fd),
+			&unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)})
+		if ctlErr != nil {
+			delete(o.sockets, int32(fd))
+			ctlErr = os.NewSyscallError("epoll_ctl", ctlErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+// addListener hands every connection accepted from l to handle in a new goroutine.
+func (o *poller) addListener(l net.Listener, handle func(conn net.Conn)) error {
+	conn, ok := l.(syscall.Conn)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return o.add(conn, func(fd int) error {
+		for i := 0; i < maxReadsPerEvent; i++ {
+			connFd, _, err := unix.Accept4(fd, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+			if err == unix.EAGAIN {
+				return nil
+			}
+			if err == unix.EINTR || err == unix.ECONNABORTED {
+				continue
+			}
+			if err != nil {
+				return os.NewSyscallError("accept4", err)
+			}
+			file := os.NewFile(uintptr(connFd), "")
+			acceptedConn, err := net.FileConn(file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+			go handle(acceptedConn)
+		}
+		return nil
+	}, func() {})
+}
+
+// addUDPRelay reads the packets of the listening socket of relay, in place of its Serve.
+func (o *poller) addUDPRelay(relay *udpRelay) error {
+	return o.add(relay.conn, func(fd int) error {
+		buf := udpBufferPool.Get().(*[]byte)
+		defer udpBufferPool.Put(buf)
+		for i := 0; i < maxReadsPerEvent; i++ {
+			n, from, err := syscall.Recvfrom(fd, *buf, syscall.MSG_DONTWAIT)
+			if err == syscall.EAGAIN {
+				return nil
+			}
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				return os.NewSyscallError("recvfrom", err)
+			}
+			relay.handlePacket((*buf)[:n], sockaddrToAddrPort(from))
+		}
+		return nil
+	}, func() {
+		relay.closeSessions(func(session *udpSession) bool { return true })
+	})
+}
+
+// run dispatches the readable sockets until Close is called.
+func (o *poller) run() {
+	defer func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.stopped = true
+		unix.Close(o.epfd)
+		unix.Close(o.wakeFd)
+		for fd, socket := range o.sockets {
+			socket.onClose()
+			delete(o.sockets, fd)
+		}
+	}()
+	events := make([]unix.EpollEvent, pollerEvents)
+	for {
+		n, err := unix.EpollWait(o.epfd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			slog.Error("Cannot wait for sockets", "error", os.NewSyscallError("epoll_wait", err))
+			return
+		}
+		for _, event := range events[:n] {
+			if event.Fd == int32(o.wakeFd) {
+				return
+			}
+			o.mu.Lock()
+			socket := o.sockets[event.Fd]
+			o.mu.Unlock()
+			if socket == nil {
+				continue
+			}
+			var readErr error
+			err := socket.rawConn.Control(func(fd uintptr) {
+				readErr = socket.read(int(fd))
+			})
+			if err == nil {
+				err = readErr
+			}
+			if errors.Is(err, net.ErrClosed) {
+				// The kernel dropped the socket from epoll when it was closed
+				o.mu.Lock()
+				delete(o.sockets, event.Fd)
+				o.mu.Unlock()
+				socket.onClose()
+			} else if err != nil {
+				slog.Warn("Cannot read polled socket", "error", err)
+				time.Sleep(pollerErrorBackoff)
+			}
+		}
+	}
+}
+
+// Close stops run.
+func (o *poller) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stopped {
+		return nil
+	}
+	_, err := unix.Write(o.wakeFd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	return err
+}
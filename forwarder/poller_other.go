@@ -0,0 +1,29 @@
+//go:build !linux
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+)
+
+// poller is only implemented on linux. Elsewhere every socket of a port range is served by its own goroutine.
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (o *poller) addListener(l net.Listener, handle func(conn net.Conn)) error {
+	return errors.ErrUnsupported
+}
+
+func (o *poller) addUDPRelay(relay *udpRelay) error {
+	return errors.ErrUnsupported
+}
+
+func (o *poller) run() {}
+
+func (o *poller) Close() error {
+	return nil
+}
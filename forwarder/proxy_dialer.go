@@ -0,0 +1,96 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/juzeon/epok-forwarder/data"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxProxyResponseSize bounds the header of the response to an HTTP CONNECT request.
+const maxProxyResponseSize = 16 * 1024
+
+// proxyDialer tunnels connections through an upstream SOCKS5 or HTTP CONNECT proxy, which resolves the
+// destination itself.
+type proxyDialer struct {
+	proxy  *url.URL
+	dialer contextDialer
+	// timeout bounds connecting to the proxy together with the handshake
+	timeout time.Duration
+}
+
+func (o *proxyDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("only tcp can be dialed via a proxy")
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	conn, err := o.dialer.DialContext(ctx, "tcp", o.proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("via %s: %w", o.proxy.Redacted(), err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	switch o.proxy.Scheme {
+	case data.ViaSOCKS5:
+		err = socks5Connect(conn, o.proxy.User, address)
+	case data.ViaHTTP:
+		err = httpConnect(conn, o.proxy.User, address)
+	default:
+		err = errors.New("unsupported proxy scheme " + o.proxy.Scheme)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("via %s: %w", o.proxy.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// httpConnect asks the HTTP proxy on conn to open a tunnel to address, authenticating as user if it is set.
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) error {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		request += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return err
+	}
+	// Read the header byte by byte, so that nothing the backend sends right after it is consumed here
+	header := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxProxyResponseSize {
+			return errors.New("http proxy response is too large")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("http proxy refused to connect: " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// dialStandIn connects to address on behalf of a stand-in proxy. backend.test stands for a host that only the
+// proxy can resolve.
+func dialStandIn(address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "backend.test" {
+		host = "127.0.0.1"
+	}
+	return net.Dial("tcp", net.JoinHostPort(host, port))
+}
+
+func pipeStandIn(client net.Conn, backend net.Conn) {
+	go func() {
+		io.Copy(backend, client)
+		backend.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(client, backend)
+	client.Close()
+	backend.Close()
+}
+
+// startSOCKS5StandIn serves a minimal SOCKS5 proxy that requires the username user and the password pass.
+func startSOCKS5StandIn(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				r := bufio.NewReader(conn)
+				b := make([]byte, 2)
+				io.ReadFull(r, b)
+				io.ReadFull(r, make([]byte, b[1]))
+				conn.Write([]byte{socks5Version, socks5MethodPassword})
+				io.ReadFull(r, b)
+				username := make([]byte, b[1])
+				io.ReadFull(r, username)
+				io.ReadFull(r, b[:1])
+				password := make([]byte, b[0])
+				io.ReadFull(r, password)
+				if string(username) != "user" || string(password) != "pass" {
+					conn.Write([]byte{socks5AuthVersion, 1})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{socks5AuthVersion, 0})
+				io.ReadFull(r, make([]byte, 3))
+				address, err := readSOCKS5Addr(r)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				backend, err := dialStandIn(address)
+				if err != nil {
+					conn.Write([]byte{socks5Version, socks5ReplyRefused, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+					conn.Close()
+					return
+				}
+				conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+				pipeStandIn(conn, backend)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startHTTPConnectStandIn serves a minimal HTTP CONNECT proxy that requires the username user and the password
+// pass.
+func startHTTPConnectStandIn(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodConnect {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		backend, err := dialStandIn(request.Host)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			backend.Close()
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		pipeStandIn(conn, backend)
+	})}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+func TestProxyDialer(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	address := net.JoinHostPort("backend.test", strconv.Itoa(backend.Addr().(*net.TCPAddr).Port))
+	for scheme, proxyAddr := range map[string]string{
+		data.ViaSOCKS5: startSOCKS5StandIn(t),
+		data.ViaHTTP:   startHTTPConnectStandIn(t),
+	} {
+		dialer := &proxyDialer{
+			proxy:  &url.URL{Scheme: scheme, User: url.UserPassword("user", "pass"), Host: proxyAddr},
+			dialer: &net.Dialer{},
+		}
+		conn, err := dialer.DialContext(context.Background(), "tcp", address)
+		assert.NoError(t, err, scheme)
+		if err != nil {
+			continue
+		}
+		_, err = conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+		reply, err := io.ReadAll(conn)
+		assert.NoError(t, err)
+		assert.Equal(t, "got:ping", string(reply), scheme)
+		conn.Close()
+
+		dialer.proxy.User = url.UserPassword("user", "wrong")
+		_, err = dialer.DialContext(context.Background(), "tcp", address)
+		assert.Error(t, err, scheme)
+	}
+}
+
+func TestProxyDialerBindSource(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	_, proxyPort, err := net.SplitHostPort(startSOCKS5StandIn(t))
+	assert.NoError(t, err)
+	dialer := &proxyDialer{
+		proxy: &url.URL{Scheme: data.ViaSOCKS5, User: url.UserPassword("user", "pass"),
+			Host: net.JoinHostPort("localhost", proxyPort)},
+		dialer: newOutboundDialer(data.Outbound{BindSource: "127.0.0.2"}, data.ForwardTCP{}),
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", backend.Addr().String())
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", string(reply))
+}
+
+func TestHostForwarderVia(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	config := data.Config{Hosts: []data.Host{{
+		Host: "backend.test",
+		Via:  "socks5://user:pass@" + startSOCKS5StandIn(t),
+		Forwards: []data.Forward{{
+			Type:        data.ForwardTypePort,
+			Bind:        "127.0.0.1",
+			ForwardPort: data.ForwardPort{Src: freePort(t), Dst: backend.Addr().(*net.TCPAddr).Port},
+		}},
+	}}}
+	assert.NoError(t, config.Validate())
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	defer waitGroup.Wait()
+	defer cancel()
+	_, err = NewHostForwarder(ctx, config.BaseConfig, config.Hosts[0], nil, waitGroup)
+	assert.NoError(t, err)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(config.Hosts[0].Forwards[0].Src)))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", string(reply))
+}
@@ -0,0 +1,143 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/samber/lo"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// proxyHandshakeTimeout bounds the time a proxy client has to authenticate and name its destination.
+const proxyHandshakeTimeout = 10 * time.Second
+
+var errDestinationNotAllowed = errors.New("destination not allowed")
+
+// proxyTarget is a forward that proxies clients to destinations of their choice.
+type proxyTarget struct {
+	*forwardTarget
+	rules data.DestinationRules
+	// via is set if destinations are dialed through the upstream proxy of the host
+	via *proxyDialer
+}
+
+func checkUser(users map[string]string, username string, password string) bool {
+	expected, ok := users[username]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// forwardProxyAsync listens for the clients of a proxy forward, which are served by serve until the listener is
+// closed.
+func (o *HostForwarder) forwardProxyAsync(target *forwardTarget,
+	serve func(l net.Listener, target *proxyTarget)) error {
+	rules, err := target.forward.Destinations.Parse()
+	if err != nil {
+		return err
+	}
+	proxy := &proxyTarget{forwardTarget: target, rules: rules}
+	if o.via != nil {
+		proxy.via = &proxyDialer{proxy: o.via, dialer: target.dialer, timeout: target.forward.ConnectTimeout}
+	}
+	for _, listenAddr := range target.forward.Bind.GetListenAddrs("tcp", target.forward.ForwardPort.Src) {
+		l, err := net.Listen(listenAddr.Network, listenAddr.Address)
+		if err != nil {
+			return err
+		}
+		o.addCloser(l)
+		go serve(l, proxy)
+	}
+	return nil
+}
+
+func (o *HostForwarder) serveSOCKS5(l net.Listener, target *proxyTarget) {
+	o.serve(l, func(conn net.Conn) { o.handleSOCKS5Conn(conn, target) })
+}
+func (o *HostForwarder) handleSOCKS5Conn(acceptedConn net.Conn, target *proxyTarget) {
+	allow, reason := target.firewallArray.CheckAllowByAddr(acceptedConn.RemoteAddr().String())
+	if !allow {
+		slog.Warn("Deny socks5 conn", "reason", reason)
+		acceptedConn.Close()
+		return
+	}
+	acceptedConn.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	user, address, err := socks5Accept(acceptedConn, target.forward.Users)
+	if err != nil {
+		slog.Warn("Cannot accept socks5 conn", "client", acceptedConn.RemoteAddr().String(), "error", err)
+		acceptedConn.Close()
+		return
+	}
+	dialedConn, err := o.dialDestination(o.ctx, target, address)
+	if err != nil {
+		slog.Warn("Cannot proxy socks5 conn", "client", acceptedConn.RemoteAddr().String(), "user", user,
+			"dst", address, "error", err)
+		socks5Reply(acceptedConn, lo.Ternary[byte](errors.Is(err, errDestinationNotAllowed),
+			socks5ReplyNotAllowed, socks5ReplyRefused), nil)
+		acceptedConn.Close()
+		return
+	}
+	if err := socks5Reply(acceptedConn, socks5ReplySucceeded, dialedConn.LocalAddr()); err != nil {
+		acceptedConn.Close()
+		dialedConn.Close()
+		return
+	}
+	acceptedConn.SetDeadline(time.Time{})
+	slog.Info("Proxy socks5 conn", "client", acceptedConn.RemoteAddr().String(), "user", user, "dst", address,
+		"reason", reason)
+	setTCPOptions(acceptedConn, target.forward.ForwardTCP)
+	relayTCP(acceptedConn, nil, dialedConn, target.forward.IdleTimeout)
+}
+
+// dialDestination connects to address if the destinations of target allow it. A host name is allowed either by
+// a host name entry, or by IP entries that allow some of its addresses, in which case only those are dialed.
+func (o *HostForwarder) dialDestination(ctx context.Context, target *proxyTarget, address string) (net.Conn,
+	error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !target.rules.AllowAddr(addr, port) {
+			return nil, errDestinationNotAllowed
+		}
+		addrs = []string{addr.String()}
+	} else if !target.rules.AllowHost(host, port) {
+		if target.via != nil {
+			// The proxy resolves host names, so IP entries cannot be checked against them
+			return nil, errDestinationNotAllowed
+		}
+		resolved, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = lo.Filter(resolved, func(item string, index int) bool {
+			addr, err := netip.ParseAddr(item)
+			return err == nil && target.rules.AllowAddr(addr, port)
+		})
+		if len(addrs) == 0 {
+			return nil, errDestinationNotAllowed
+		}
+	}
+	return dialTCP(ctx, func(ctx context.Context, port int) (net.Conn, error) {
+		if target.via != nil {
+			return target.via.DialContext(ctx, "tcp", address)
+		}
+		if addrs == nil {
+			resolved, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			return dialAddrs(ctx, target.dialer, "tcp", resolved, port)
+		}
+		return dialAddrs(ctx, target.dialer, "tcp", addrs, port)
+	}, port, target.forward.ForwardTCP)
+}
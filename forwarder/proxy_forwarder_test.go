@@ -0,0 +1,140 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// startProxyForward serves forward, with the backend as its host, and returns the address it listens on.
+func startProxyForward(t *testing.T, forward data.Forward) string {
+	forward.Bind = "127.0.0.1"
+	forward.ForwardPort = data.ForwardPort{Src: freePort(t)}
+	config := data.Config{Hosts: []data.Host{{Host: "127.0.0.1", Forwards: []data.Forward{forward}}}}
+	assert.NoError(t, config.Validate())
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		waitGroup.Wait()
+	})
+	_, err := NewHostForwarder(ctx, config.BaseConfig, config.Hosts[0], nil, waitGroup)
+	assert.NoError(t, err)
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(forward.ForwardPort.Src))
+}
+
+// pingThrough sends ping over conn, half-closes it and returns the reply of a serveUntilEOF backend.
+func pingThrough(t *testing.T, conn net.Conn) string {
+	_, err := conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	return string(reply)
+}
+
+func TestSOCKS5Forward(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	addr := startProxyForward(t, data.Forward{
+		Type:         data.ForwardTypeSOCKS5,
+		ForwardProxy: data.ForwardProxy{Users: map[string]string{"user": "pass"}, Destinations: "localhost"},
+	})
+	connect := func(addr string, user *url.Userinfo, address string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, socks5Connect(conn, user, address)
+	}
+	user := url.UserPassword("user", "pass")
+	backendPort := strconv.Itoa(backend.Addr().(*net.TCPAddr).Port)
+	conn, err := connect(addr, user, net.JoinHostPort("localhost", backendPort))
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", pingThrough(t, conn))
+	// An IP address is only allowed by IP entries
+	_, err = connect(addr, user, net.JoinHostPort("127.0.0.1", backendPort))
+	assert.ErrorContains(t, err, "reply 2")
+	_, err = connect(addr, url.UserPassword("user", "wrong"), net.JoinHostPort("localhost", backendPort))
+	assert.ErrorContains(t, err, "authentication failed")
+	_, err = connect(addr, nil, net.JoinHostPort("localhost", backendPort))
+	assert.Error(t, err)
+
+	addr = startProxyForward(t, data.Forward{
+		Type:         data.ForwardTypeSOCKS5,
+		ForwardProxy: data.ForwardProxy{Destinations: data.Destinations("127.0.0.0/8:" + backendPort)},
+	})
+	conn, err = connect(addr, nil, net.JoinHostPort("127.0.0.1", backendPort))
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", pingThrough(t, conn))
+	// A host name is allowed by IP entries that match its addresses
+	conn, err = connect(addr, nil, net.JoinHostPort("localhost", backendPort))
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", pingThrough(t, conn))
+	_, err = connect(addr, nil, net.JoinHostPort("127.0.0.1", "1"))
+	assert.ErrorContains(t, err, "reply 2")
+
+	addr = startProxyForward(t, data.Forward{
+		Type:     data.ForwardTypeSOCKS5,
+		Firewall: data.Firewall{Deny: "127.0.0.1"},
+	})
+	_, err = connect(addr, nil, net.JoinHostPort("127.0.0.1", backendPort))
+	assert.Error(t, err)
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	web := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		io.WriteString(writer, "hello "+request.Host+" "+request.Header.Get("Proxy-Authorization"))
+	}))
+	defer web.Close()
+	addr := startProxyForward(t, data.Forward{
+		Type:         data.ForwardTypeHTTPProxy,
+		ForwardProxy: data.ForwardProxy{Users: map[string]string{"user": "pass"}, Destinations: "localhost"},
+	})
+	connect := func(user *url.Userinfo, address string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn, httpConnect(conn, user, address)
+	}
+	user := url.UserPassword("user", "pass")
+	backendPort := strconv.Itoa(backend.Addr().(*net.TCPAddr).Port)
+	conn, err := connect(user, net.JoinHostPort("localhost", backendPort))
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", pingThrough(t, conn))
+	_, err = connect(user, net.JoinHostPort("127.0.0.1", backendPort))
+	assert.ErrorContains(t, err, "403")
+	_, err = connect(url.UserPassword("user", "wrong"), net.JoinHostPort("localhost", backendPort))
+	assert.ErrorContains(t, err, "407")
+
+	get := func(user *url.Userinfo, target string) (int, string) {
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: user, Host: addr}),
+		}}
+		resp, err := client.Get(target)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+	webHost := net.JoinHostPort("localhost", strconv.Itoa(web.Listener.Addr().(*net.TCPAddr).Port))
+	status, body := get(user, "http://"+webHost+"/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "hello "+webHost+" ", body)
+	status, _ = get(user, web.URL)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = get(nil, "http://"+webHost+"/")
+	assert.Equal(t, http.StatusProxyAuthRequired, status)
+}
@@ -0,0 +1,286 @@
+package forwarder
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// quicVersion holds what tells the Initial packets of a QUIC version apart and protects them.
+type quicVersion struct {
+	// initialType is the long header packet type of Initial packets
+	initialType uint8
+	salt        []byte
+	labelPrefix string
+}
+
+// quicVersions are QUIC v1 (RFC 9001) and v2 (RFC 9369).
+var quicVersions = map[uint32]quicVersion{
+	0x00000001: {
+		initialType: 0,
+		salt: []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad,
+			0xcc, 0xbb, 0x7f, 0x0a},
+		labelPrefix: "quic ",
+	},
+	0x6b3343cf: {
+		initialType: 1,
+		salt: []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb,
+			0xf9, 0xbd, 0x2e, 0xd9},
+		labelPrefix: "quicv2 ",
+	},
+}
+
+const (
+	// maxQUICCryptoFrames bounds the CRYPTO frames collected for a ClientHello, which keeps reassembly cheap
+	maxQUICCryptoFrames = 256
+	frameTypePadding    = 0x00
+	frameTypePing       = 0x01
+	frameTypeACK        = 0x02
+	frameTypeACKECN     = 0x03
+	frameTypeCrypto     = 0x06
+	frameTypeClose      = 0x1c
+)
+
+var errNotQUICInitial = errors.New("not a quic initial packet")
+
+// quicInitialKeys are the keys protecting the Initial packets of a client.
+type quicInitialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newQUICInitialKeys derives the client Initial keys of version from the destination connection ID chosen by the
+// client.
+func newQUICInitialKeys(version quicVersion, dcid []byte) (*quicInitialKeys, error) {
+	initialSecret := hkdf.Extract(sha256.New, dcid, version.salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", sha256.Size)
+	key, err := aes.NewCipher(hkdfExpandLabel(clientSecret, version.labelPrefix+"key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(clientSecret, version.labelPrefix+"hp", 16))
+	if err != nil {
+		return nil, err
+	}
+	return &quicInitialKeys{aead: aead, iv: hkdfExpandLabel(clientSecret, version.labelPrefix+"iv", 12), hp: hp}, nil
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of TLS 1.3 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("tls13 " + label)) })
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	out := make([]byte, length)
+	// Reading less than 255 hashes of output cannot fail
+	hkdf.Expand(sha256.New, secret, b.BytesOrPanic()).Read(out)
+	return out
+}
+
+// openQUICInitial reads the long header packet at the start of datagram, and returns the decrypted payload if it is
+// an Initial packet, or nil for another type, along with the rest of the datagram, which may hold coalesced
+// packets. A short header packet, which cannot be coalesced before another, ends the datagram.
+func openQUICInitial(datagram []byte) ([]byte, []byte, error) {
+	s := cryptobyte.String(datagram)
+	var first uint8
+	var versionNumber uint32
+	var dcid, scid cryptobyte.String
+	if !s.ReadUint8(&first) {
+		return nil, nil, errNotQUICInitial
+	}
+	if first&0x80 == 0 {
+		return nil, nil, nil
+	}
+	if !s.ReadUint32(&versionNumber) || !s.ReadUint8LengthPrefixed(&dcid) || !s.ReadUint8LengthPrefixed(&scid) ||
+		len(dcid) > 20 || len(scid) > 20 {
+		return nil, nil, errNotQUICInitial
+	}
+	version, ok := quicVersions[versionNumber]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported quic version %#x", versionNumber)
+	}
+	initial := (first>>4)&0x03 == version.initialType
+	if initial {
+		var tokenLength uint64
+		if !readVarint(&s, &tokenLength) || tokenLength > uint64(len(s)) || !s.Skip(int(tokenLength)) {
+			return nil, nil, errNotQUICInitial
+		}
+	}
+	var length uint64
+	if !readVarint(&s, &length) || length > uint64(len(s)) {
+		return nil, nil, errNotQUICInitial
+	}
+	pnOffset := len(datagram) - len(s)
+	end := pnOffset + int(length)
+	if !initial {
+		return nil, datagram[end:], nil
+	}
+	// The packet number is up to 4 bytes long, and the header protection sample starts right after those 4 bytes
+	if end < pnOffset+4+16 {
+		return nil, nil, errNotQUICInitial
+	}
+	keys, err := newQUICInitialKeys(version, dcid)
+	if err != nil {
+		return nil, nil, err
+	}
+	packet := make([]byte, end)
+	copy(packet, datagram)
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0x0f
+	pnLength := int(packet[0]&0x03) + 1
+	nonce := make([]byte, len(keys.iv))
+	copy(nonce, keys.iv)
+	for i := 0; i < pnLength; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		nonce[len(nonce)-pnLength+i] ^= packet[pnOffset+i]
+	}
+	header := packet[:pnOffset+pnLength]
+	payload, err := keys.aead.Open(nil, nonce, packet[len(header):], header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot decrypt quic initial packet: %w", err)
+	}
+	return payload, datagram[end:], nil
+}
+
+// readVarint reads a QUIC variable-length integer.
+func readVarint(s *cryptobyte.String, out *uint64) bool {
+	var first uint8
+	if !s.ReadUint8(&first) {
+		return false
+	}
+	value := uint64(first & 0x3f)
+	for i := 1; i < 1<<(first>>6); i++ {
+		var b uint8
+		if !s.ReadUint8(&b) {
+			return false
+		}
+		value = value<<8 | uint64(b)
+	}
+	*out = value
+	return true
+}
+
+// readCryptoFrames calls add with the offset and data of every CRYPTO frame in the payload of an Initial packet.
+func readCryptoFrames(payload []byte, add func(offset uint64, data []byte) error) error {
+	s := cryptobyte.String(payload)
+	for !s.Empty() {
+		var frameType uint64
+		if !readVarint(&s, &frameType) {
+			return errors.New("malformed quic frame")
+		}
+		var ok bool
+		switch frameType {
+		case frameTypePadding, frameTypePing:
+			ok = true
+		case frameTypeACK, frameTypeACKECN:
+			var largest, delay, rangeCount, firstRange uint64
+			ok = readVarint(&s, &largest) && readVarint(&s, &delay) && readVarint(&s, &rangeCount) &&
+				readVarint(&s, &firstRange) && rangeCount <= uint64(len(s))
+			var gap, rangeLength uint64
+			for i := uint64(0); ok && i < rangeCount; i++ {
+				ok = readVarint(&s, &gap) && readVarint(&s, &rangeLength)
+			}
+			if ok && frameType == frameTypeACKECN {
+				var ect0, ect1, ce uint64
+				ok = readVarint(&s, &ect0) && readVarint(&s, &ect1) && readVarint(&s, &ce)
+			}
+		case frameTypeCrypto:
+			var offset, length uint64
+			var data []byte
+			ok = readVarint(&s, &offset) && readVarint(&s, &length) && length <= uint64(len(s)) &&
+				s.ReadBytes(&data, int(length))
+			if ok {
+				if err := add(offset, data); err != nil {
+					return err
+				}
+			}
+		case frameTypeClose:
+			return errors.New("quic connection closed by client")
+		default:
+			return fmt.Errorf("unexpected quic frame type %#x in initial packet", frameType)
+		}
+		if !ok {
+			return fmt.Errorf("malformed quic frame of type %#x", frameType)
+		}
+	}
+	return nil
+}
+
+// quicClientHello reassembles the ClientHello carried by the CRYPTO frames of the Initial packets of a client,
+// which may span several packets and datagrams and arrive out of order.
+type quicClientHello struct {
+	frames []quicCryptoFrame
+}
+
+type quicCryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// add reads the Initial packets of a datagram, and returns the ClientHello once it is complete, or nil if more
+// packets are needed.
+func (o *quicClientHello) add(datagram []byte) (*tls.ClientHelloInfo, error) {
+	for len(datagram) != 0 {
+		payload, rest, err := openQUICInitial(datagram)
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil {
+			err = readCryptoFrames(payload, func(offset uint64, data []byte) error {
+				if len(o.frames) >= maxQUICCryptoFrames || offset+uint64(len(data)) > maxClientHelloSize {
+					return errors.New("quic client hello is too large")
+				}
+				o.frames = append(o.frames, quicCryptoFrame{offset: offset, data: data})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		datagram = rest
+	}
+	message := o.assemble()
+	if len(message) < 4 {
+		return nil, nil
+	}
+	if message[0] != handshakeTypeClientHello {
+		return nil, errNotClientHello
+	}
+	size := 4 + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+	if size > maxClientHelloSize {
+		return nil, fmt.Errorf("tls client hello of %d bytes is too large", size)
+	}
+	if len(message) < size {
+		return nil, nil
+	}
+	return parseClientHello(message[:size])
+}
+
+// assemble returns the contiguous crypto data from offset 0 received so far.
+func (o *quicClientHello) assemble() []byte {
+	var message []byte
+	for {
+		progressed := false
+		for _, frame := range o.frames {
+			start, end := frame.offset, frame.offset+uint64(len(frame.data))
+			if start <= uint64(len(message)) && end > uint64(len(message)) {
+				message = append(message, frame.data[uint64(len(message))-start:]...)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return message
+		}
+	}
+}
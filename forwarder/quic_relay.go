@@ -0,0 +1,220 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/juzeon/epok-forwarder/data"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQUICPendingSessions bounds the clients whose ClientHello is still being collected
+	maxQUICPendingSessions = 1024
+	// maxQUICPendingPackets bounds the datagrams kept for a client until its ClientHello is complete
+	maxQUICPendingPackets = 16
+)
+
+// quicRelay routes the QUIC clients of a UDP socket by the SNI of their Initial packets, and then relays their
+// datagrams to the https port of the chosen target like a udpRelay.
+type quicRelay struct {
+	ctx      context.Context
+	conn     *net.UDPConn
+	web      *WebForwarder
+	sessions map[netip.AddrPort]*quicSession
+	mu       sync.Mutex
+}
+
+type quicSession struct {
+	*udpSession
+	// hello collects the ClientHello until a target is chosen. It is nil once the session is relayed or dropped.
+	hello *quicClientHello
+	// pending holds the datagrams received before a target is chosen, which are then sent to it
+	pending [][]byte
+	// timeout is how long the session lasts without packets
+	timeout time.Duration
+}
+
+func newQUICRelay(ctx context.Context, conn *net.UDPConn, web *WebForwarder) *quicRelay {
+	return &quicRelay{
+		ctx:      ctx,
+		conn:     conn,
+		web:      web,
+		sessions: map[netip.AddrPort]*quicSession{},
+	}
+}
+
+// Serve relays packets until the listening socket is closed. Idle sessions are dropped by calls to expireSessions.
+func (o *quicRelay) Serve() {
+	for {
+		err := readFromUDP(o.conn, o.handlePacket)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			slog.Warn("Cannot read quic packet", "error", err)
+		}
+	}
+	o.closeSessions(func(session *quicSession) bool { return true })
+}
+
+func (o *quicRelay) handlePacket(packet []byte, clientAddr netip.AddrPort) {
+	session, clientHello := o.collect(packet, clientAddr)
+	if clientHello == nil {
+		return
+	}
+	// Sessions are only routed from the Serve goroutine, so the upstream is dialed without holding mu
+	upstream, timeout, ok := o.dial(clientHello, clientAddr)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sessions[clientAddr] != session {
+		// The session expired meanwhile
+		if ok {
+			upstream.Close()
+		}
+		return
+	}
+	if !ok {
+		session.drop()
+		return
+	}
+	session.upstream = upstream
+	session.timeout = timeout
+	for _, packet := range session.pending {
+		if _, err := session.upstream.Write(packet); err != nil {
+			slog.Warn("Cannot write udp packet", "error", err)
+		}
+	}
+	session.hello, session.pending = nil, nil
+	go session.relayReplies(o.conn)
+}
+
+// collect relays a packet of a routed session, or adds it to the ClientHello of the session. It returns the
+// ClientHello once it is complete.
+func (o *quicRelay) collect(packet []byte, clientAddr netip.AddrPort) (*quicSession, *tls.ClientHelloInfo) {
+	o.mu.Lock()
+	session, ok := o.sessions[clientAddr]
+	if ok && session.upstream != nil {
+		o.mu.Unlock()
+		session.write(packet)
+		return nil, nil
+	}
+	defer o.mu.Unlock()
+	if !ok {
+		pending := 0
+		for _, session := range o.sessions {
+			if session.hello != nil {
+				pending++
+			}
+		}
+		if pending >= maxQUICPendingSessions {
+			slog.Warn("Drop quic flow due to too many pending sessions", "client", clientAddr.String())
+			return nil, nil
+		}
+		session = &quicSession{
+			udpSession: &udpSession{clientAddr: clientAddr, started: time.Now()},
+			hello:      &quicClientHello{},
+			timeout:    o.web.baseConfig.ClientHelloTimeout,
+		}
+		o.sessions[clientAddr] = session
+	}
+	session.lastActive.Store(time.Now().UnixNano())
+	session.packetsIn.Add(1)
+	session.bytesIn.Add(uint64(len(packet)))
+	if session.hello == nil {
+		return nil, nil
+	}
+	// The packet is read into a pooled buffer
+	session.pending = append(session.pending, slices.Clone(packet))
+	clientHello, err := session.hello.add(packet)
+	if err != nil {
+		slog.Warn("Cannot parse quic initial", "client", clientAddr.String(), "err", err)
+		session.drop()
+		return nil, nil
+	}
+	if clientHello == nil && len(session.pending) >= maxQUICPendingPackets {
+		slog.Warn("Drop quic flow without client hello", "client", clientAddr.String(),
+			"packets", len(session.pending))
+		session.drop()
+	}
+	return session, clientHello
+}
+
+// dial connects to the https port of the target of a client and returns the udp_timeout of the target, or reports
+// false if there is none or the client is denied.
+func (o *quicRelay) dial(clientHello *tls.ClientHelloInfo, clientAddr netip.AddrPort) (*net.UDPConn, time.Duration,
+	bool) {
+	target, ok := o.web.findHttpsTarget(o.web.baseConfig.Https, clientHello)
+	if !ok {
+		slog.Warn("No hostname matches", "hostname", clientHello.ServerName, "alpn", clientHello.SupportedProtos,
+			"protocol", "quic")
+		return nil, 0, false
+	}
+	allow, reason := target.FirewallArray.CheckAllowAddr(clientAddr.Addr())
+	if !allow {
+		slog.Warn("Deny quic flow", "client", clientAddr.String(), "reason", reason)
+		return nil, 0, false
+	}
+	if target.DialUDP == nil {
+		slog.Warn("Cannot relay quic via a proxy", "hostname", clientHello.ServerName)
+		return nil, 0, false
+	}
+	if target.TLSConfig != nil {
+		// TLS, and with it client certificates, is only terminated for tcp, so quic would reach the backend unchecked
+		slog.Warn("Cannot relay quic to a target terminating tls", "hostname", clientHello.ServerName)
+		return nil, 0, false
+	}
+	upstream, err := target.DialUDP(o.ctx, target.DstHttpsPort)
+	if err != nil {
+		slog.Warn("Cannot dial udp", "error", err)
+		return nil, 0, false
+	}
+	slog.Info("Serve quic", "client", clientAddr.String(), "dst", upstream.RemoteAddr().String(),
+		"hostname", clientHello.ServerName, "reason", reason)
+	return upstream.(*net.UDPConn), target.UDPOptions.UDPTimeout, true
+}
+
+// drop stops collecting the ClientHello of the session, whose packets are then dropped until it expires.
+func (o *quicSession) drop() {
+	o.hello, o.pending = nil, nil
+}
+
+// expireSessions drops the sessions idle for longer than their timeout, and the ones whose ClientHello is not
+// complete within client_hello_timeout.
+func (o *quicRelay) expireSessions(now time.Time) {
+	helloDeadline := now.Add(-o.web.baseConfig.ClientHelloTimeout)
+	o.closeSessions(func(session *quicSession) bool {
+		return session.lastActive.Load() < now.Add(-session.timeout).UnixNano() ||
+			session.hello != nil && session.started.Before(helloDeadline)
+	})
+}
+
+func (o *quicRelay) closeSessions(filter func(session *quicSession) bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for clientAddr, session := range o.sessions {
+		if !filter(session) {
+			continue
+		}
+		if session.upstream != nil {
+			session.upstream.Close()
+		}
+		delete(o.sessions, clientAddr)
+	}
+}
+
+func (o *quicRelay) GetFlows() []data.UDPFlow {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var flows []data.UDPFlow
+	for _, session := range o.sessions {
+		flows = append(flows, session.getFlow(o.conn.LocalAddr().String(), "",
+			session.upstream == nil && session.hello == nil))
+	}
+	return flows
+}
@@ -0,0 +1,265 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+	"net"
+	"testing"
+	"time"
+)
+
+func mustDecodeHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(s)
+	assert.NoError(t, err)
+	return b
+}
+
+// quicClientHelloMessage returns the ClientHello a crypto/tls QUIC client sends with config.
+func quicClientHelloMessage(t testing.TB, config *tls.Config) []byte {
+	conn := tls.QUICClient(&tls.QUICConfig{TLSConfig: config})
+	conn.SetTransportParameters([]byte{})
+	assert.NoError(t, conn.Start(context.Background()))
+	defer conn.Close()
+	var message []byte
+	for event := conn.NextEvent(); event.Kind != tls.QUICNoEvent; event = conn.NextEvent() {
+		if event.Kind == tls.QUICWriteData && event.Level == tls.QUICEncryptionLevelInitial {
+			message = append(message, event.Data...)
+		}
+	}
+	return message
+}
+
+// cryptoFrame encodes a CRYPTO frame of data at offset.
+func cryptoFrame(offset int, data []byte) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(frameTypeCrypto)
+	b.AddUint32(0x80000000 | uint32(offset))
+	b.AddUint32(0x80000000 | uint32(len(data)))
+	b.AddBytes(data)
+	return b.BytesOrPanic()
+}
+
+// sealQUICInitial returns a client Initial packet of versionNumber carrying frames with packet number pn, padded to
+// 1200 bytes as clients do.
+func sealQUICInitial(t testing.TB, versionNumber uint32, dcid []byte, pn uint32, frames []byte) []byte {
+	version := quicVersions[versionNumber]
+	keys, err := newQUICInitialKeys(version, dcid)
+	assert.NoError(t, err)
+	const pnLength = 4
+	headerLength := 1 + 4 + 1 + len(dcid) + 1 + 1 + 2 + pnLength
+	payload := append(frames, make([]byte, max(0, 1200-headerLength-len(frames)-16))...)
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0xc0 | version.initialType<<4 | (pnLength - 1))
+	b.AddUint32(versionNumber)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(dcid) })
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint8(0) // token
+	b.AddUint16(0x4000 | uint16(pnLength+len(payload)+16))
+	b.AddUint32(pn)
+	header := b.BytesOrPanic()
+	nonce := append([]byte{}, keys.iv...)
+	for i := 0; i < pnLength; i++ {
+		nonce[len(nonce)-pnLength+i] ^= header[len(header)-pnLength+i]
+	}
+	packet := keys.aead.Seal(append([]byte{}, header...), nonce, payload, header)
+	pnOffset := len(header) - pnLength
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+16])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLength; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func TestQUICInitialKeys(t *testing.T) {
+	// RFC 9001 Appendix A and RFC 9369 Appendix A
+	dcid := mustDecodeHex(t, "8394c8f03e515708")
+	for _, c := range []struct {
+		version uint32
+		key     string
+		iv      string
+		hp      string
+	}{
+		{0x00000001, "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{0x6b3343cf, "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+	} {
+		version := quicVersions[c.version]
+		clientSecret := hkdfExpandLabel(hkdf.Extract(sha256.New, dcid, version.salt), "client in", sha256.Size)
+		assert.Equal(t, c.key, hex.EncodeToString(hkdfExpandLabel(clientSecret, version.labelPrefix+"key", 16)))
+		assert.Equal(t, c.iv, hex.EncodeToString(hkdfExpandLabel(clientSecret, version.labelPrefix+"iv", 12)))
+		assert.Equal(t, c.hp, hex.EncodeToString(hkdfExpandLabel(clientSecret, version.labelPrefix+"hp", 16)))
+	}
+	keys, err := newQUICInitialKeys(quicVersions[1], dcid)
+	assert.NoError(t, err)
+	assert.Equal(t, "fa044b2f42a3fd3b46fb255c", hex.EncodeToString(keys.iv))
+	mask := make([]byte, aes.BlockSize)
+	keys.hp.Encrypt(mask, mustDecodeHex(t, "d1b1c98dd7689fb8ec11d242b123dc9b"))
+	assert.Equal(t, "437b9aec36", hex.EncodeToString(mask[:5]))
+}
+
+func TestQUICClientHello(t *testing.T) {
+	message := quicClientHelloMessage(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h3"}})
+	dcid := mustDecodeHex(t, "8394c8f03e515708")
+	half := len(message) / 2
+	for name, datagrams := range map[string][][]byte{
+		"single": {sealQUICInitial(t, 1, dcid, 0, cryptoFrame(0, message))},
+		"v2":     {sealQUICInitial(t, 0x6b3343cf, dcid, 0, cryptoFrame(0, message))},
+		// The ClientHello spans two datagrams, received out of order
+		"split": {
+			sealQUICInitial(t, 1, dcid, 1, cryptoFrame(half, message[half:])),
+			sealQUICInitial(t, 1, dcid, 0, cryptoFrame(0, message[:half])),
+		},
+		// Two coalesced packets with overlapping, reordered frames and a PING
+		"coalesced": {append(
+			sealQUICInitial(t, 1, dcid, 0, append(cryptoFrame(10, message[10:half]), frameTypePing)),
+			sealQUICInitial(t, 1, dcid, 1, append(cryptoFrame(half-5, message[half-5:]),
+				cryptoFrame(0, message[:20])...))...)},
+	} {
+		hello := &quicClientHello{}
+		var clientHello *tls.ClientHelloInfo
+		for i, datagram := range datagrams {
+			var err error
+			clientHello, err = hello.add(datagram)
+			assert.NoError(t, err, name)
+			assert.Equal(t, i == len(datagrams)-1, clientHello != nil, name)
+		}
+		if assert.NotNil(t, clientHello, name) {
+			assert.Equal(t, "example.com", clientHello.ServerName, name)
+			assert.Equal(t, []string{"h3"}, clientHello.SupportedProtos, name)
+		}
+	}
+
+	packet := sealQUICInitial(t, 1, dcid, 0, cryptoFrame(0, message))
+	packet[len(packet)-1] ^= 1
+	_, err := (&quicClientHello{}).add(packet)
+	assert.ErrorContains(t, err, "cannot decrypt")
+	_, err = (&quicClientHello{}).add([]byte{0xc0, 0xfa, 0xce, 0xb0, 0x0c, 0, 0})
+	assert.ErrorContains(t, err, "unsupported quic version")
+	// A short header packet is skipped
+	clientHello, err := (&quicClientHello{}).add([]byte{0x40, 1, 2, 3})
+	assert.NoError(t, err)
+	assert.Nil(t, clientHello)
+}
+
+func FuzzQUICClientHello(f *testing.F) {
+	message := quicClientHelloMessage(f, &tls.Config{ServerName: "example.com", NextProtos: []string{"h3"}})
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	f.Add(sealQUICInitial(f, 1, dcid, 0, cryptoFrame(0, message)))
+	f.Add(sealQUICInitial(f, 1, dcid, 0, cryptoFrame(0, message[:100])))
+	f.Add(sealQUICInitial(f, 0x6b3343cf, dcid, 0, []byte{frameTypeACK, 0, 0, 0, 0}))
+	f.Fuzz(func(t *testing.T, datagram []byte) {
+		(&quicClientHello{}).add(datagram)
+	})
+}
+
+// startQUICEcho answers every datagram received on addr with "echo:" and the datagram.
+func startQUICEcho(t *testing.T, addr string) net.PacketConn {
+	backend, err := net.ListenPacket("udp", addr)
+	assert.NoError(t, err)
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+	return backend
+}
+
+func TestQUICRelay(t *testing.T) {
+	backend := startQUICEcho(t, "127.0.0.1:0")
+	_, httpsAddr := serveWebForwarder(t, data.BaseConfig{ClientHelloTimeout: 5 * time.Second, QUIC: true},
+		data.WebForwardTarget{
+			Hostname:     "example.com",
+			DstHttpsPort: backend.LocalAddr().(*net.UDPAddr).Port,
+			UDPOptions:   data.ForwardUDP{UDPTimeout: time.Minute},
+		})
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	exchange := func(httpsAddr string, serverName string) []byte {
+		conn, err := net.Dial("udp", httpsAddr)
+		assert.NoError(t, err)
+		defer conn.Close()
+		message := quicClientHelloMessage(t, &tls.Config{ServerName: serverName, NextProtos: []string{"h3"}})
+		half := len(message) / 2
+		first := sealQUICInitial(t, 1, dcid, 0, cryptoFrame(0, message[:half]))
+		second := sealQUICInitial(t, 1, dcid, 1, cryptoFrame(half, message[half:]))
+		for _, datagram := range [][]byte{first, second, []byte("short header")} {
+			_, err = conn.Write(datagram)
+			assert.NoError(t, err)
+		}
+		// Every datagram is relayed, including the ones received before the ClientHello was complete
+		var replies []byte
+		buf := make([]byte, 2048)
+		for {
+			assert.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return replies
+			}
+			replies = append(replies, buf[:n]...)
+		}
+	}
+	replies := exchange(httpsAddr, "example.com")
+	assert.True(t, bytes.Contains(replies, []byte("short header")))
+	assert.Equal(t, 3, bytes.Count(replies, []byte("echo:")))
+	assert.Empty(t, exchange(httpsAddr, "other.test"))
+
+	// A target terminating TLS would be reached without its client certificate check
+	_, httpsAddr = serveWebForwarder(t, data.BaseConfig{ClientHelloTimeout: 5 * time.Second, QUIC: true},
+		data.WebForwardTarget{
+			Hostname:     "example.com",
+			DstHttpsPort: backend.LocalAddr().(*net.UDPAddr).Port,
+			UDPOptions:   data.ForwardUDP{UDPTimeout: time.Minute},
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{newTestCertificate(t, "example.com")},
+				ClientCAs:    x509.NewCertPool(),
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			},
+		})
+	assert.Empty(t, exchange(httpsAddr, "example.com"))
+}
+
+func TestQUICRelayBackendRestart(t *testing.T) {
+	backend := startQUICEcho(t, "127.0.0.1:0")
+	_, httpsAddr := serveWebForwarder(t, data.BaseConfig{ClientHelloTimeout: 5 * time.Second, QUIC: true},
+		data.WebForwardTarget{
+			Hostname:     "example.com",
+			DstHttpsPort: backend.LocalAddr().(*net.UDPAddr).Port,
+			UDPOptions:   data.ForwardUDP{UDPTimeout: time.Minute},
+		})
+	conn, err := net.Dial("udp", httpsAddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 2048)
+	exchange := func(datagram []byte) ([]byte, error) {
+		_, err := conn.Write(datagram)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+	message := quicClientHelloMessage(t, &tls.Config{ServerName: "example.com", NextProtos: []string{"h3"}})
+	_, err = exchange(sealQUICInitial(t, 1, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0, cryptoFrame(0, message)))
+	assert.NoError(t, err)
+	backend.Close()
+	_, err = exchange([]byte("down"))
+	assert.Error(t, err)
+	startQUICEcho(t, backend.LocalAddr().String())
+	reply, err := exchange([]byte("after"))
+	assert.NoError(t, err)
+	assert.Equal(t, "echo:after", string(reply))
+}
@@ -0,0 +1,137 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// resolveRetry is how soon a failed lookup is retried. Until then the previous addresses, if any, are kept.
+	resolveRetry = 5 * time.Second
+	// resolveTimeout bounds a lookup, which runs on its own once started
+	resolveTimeout = 10 * time.Second
+)
+
+// hostResolver caches the addresses of a backend host and re-resolves them once they expire, so that a backend behind
+// a changing DNS record is followed without restarting. Addresses expire after the TTL of their DNS records, capped by
+// ttl, or after ttl if the TTL is not known.
+type hostResolver struct {
+	host string
+	ttl  time.Duration
+	// lookup returns the addresses of host and their TTL, 0 if it is not known
+	lookup func(ctx context.Context, host string) ([]string, time.Duration, error)
+	// mu guards the fields below. It is not held during lookups, so that callers are never blocked by a slow DNS
+	// server while addresses are cached.
+	mu      sync.Mutex
+	addrs   []string
+	err     error
+	expires time.Time
+	// refreshing is closed once the running lookup is done. It is nil if there is none, so that an expired entry is
+	// only resolved once.
+	refreshing chan struct{}
+}
+
+func newHostResolver(host string, ttl time.Duration) *hostResolver {
+	return &hostResolver{
+		host:   host,
+		ttl:    ttl,
+		lookup: (&ttlLookup{dial: (&net.Dialer{}).DialContext}).LookupHost,
+	}
+}
+
+// Resolve returns every address of the host. Once they are expired, the previous addresses are returned while the
+// host is resolved again in the background. Resolve only waits for a lookup if there are no addresses yet, and only
+// reports an error if the last lookup failed and no earlier one succeeded.
+func (o *hostResolver) Resolve(ctx context.Context) ([]string, error) {
+	o.mu.Lock()
+	if !time.Now().Before(o.expires) {
+		done := o.refresh()
+		if len(o.addrs) == 0 {
+			o.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-done:
+			}
+			o.mu.Lock()
+		}
+	}
+	defer o.mu.Unlock()
+	if len(o.addrs) == 0 {
+		return nil, o.err
+	}
+	return o.addrs, nil
+}
+
+// refresh starts a lookup unless one is running, and returns a channel closed once it is done. o.mu must be held.
+func (o *hostResolver) refresh() chan struct{} {
+	if o.refreshing != nil {
+		return o.refreshing
+	}
+	done := make(chan struct{})
+	o.refreshing = done
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		addrs, recordTTL, err := o.lookup(ctx, o.host)
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.refreshing = nil
+		o.err = err
+		if err != nil {
+			o.expires = time.Now().Add(resolveRetry)
+			if len(o.addrs) != 0 {
+				slog.Warn("Cannot resolve host, keep previous addresses", "host", o.host, "addrs", o.addrs,
+					"err", err)
+			}
+			return
+		}
+		if !slices.Equal(addrs, o.addrs) {
+			slog.Info("Resolve host", "host", o.host, "addrs", addrs)
+		}
+		o.addrs = addrs
+		ttl := o.ttl
+		if recordTTL > 0 {
+			ttl = min(ttl, recordTTL)
+		}
+		o.expires = time.Now().Add(ttl)
+	}()
+	return done
+}
+
+// DialContext dials port on the addresses of the host in turn until one of them accepts.
+func (o *hostResolver) DialContext(ctx context.Context, dialer contextDialer, network string,
+	port int) (net.Conn, error) {
+	addrs, err := o.Resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dialAddrs(ctx, dialer, network, addrs, port)
+}
+
+// dialAddrs dials port on addrs in turn until one of them accepts.
+func dialAddrs(ctx context.Context, dialer contextDialer, network string, addrs []string,
+	port int) (net.Conn, error) {
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no address to dial")
+	}
+	return nil, errors.Join(errs...)
+}
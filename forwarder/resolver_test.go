@@ -0,0 +1,189 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHostResolver(t *testing.T) {
+	lookups := make(chan struct{}, 10)
+	release := make(chan error)
+	resolver := newHostResolver("backend", time.Minute)
+	resolver.lookup = func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		lookups <- struct{}{}
+		return []string{"127.0.0.2", "127.0.0.1"}, 0, <-release
+	}
+	go func() { release <- nil }()
+	addrs, err := resolver.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.1"}, addrs)
+	_, err = resolver.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, lookups, 1)
+	<-lookups
+
+	// Expired addresses are served while the lookup is still waiting for the DNS server
+	resolver.mu.Lock()
+	resolver.expires = time.Now()
+	resolver.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		addrs, err = resolver.Resolve(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"127.0.0.2", "127.0.0.1"}, addrs)
+	}
+	<-lookups
+	resolver.mu.Lock()
+	done := resolver.refreshing
+	resolver.mu.Unlock()
+	release <- errors.New("no such host")
+	<-done
+	addrs, err = resolver.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.1"}, addrs)
+	assert.Len(t, lookups, 0)
+
+	resolver = newHostResolver("backend", time.Minute)
+	failures := 0
+	resolver.lookup = func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		failures++
+		return nil, 0, errors.New("no such host")
+	}
+	_, err = resolver.Resolve(context.Background())
+	assert.Error(t, err)
+	_, err = resolver.Resolve(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, failures)
+
+	// The TTL of the records is honored below ttl
+	resolver = newHostResolver("backend", time.Minute)
+	resolver.lookup = func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		return []string{"127.0.0.1"}, 10 * time.Second, nil
+	}
+	_, err = resolver.Resolve(context.Background())
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Second), resolver.expires, time.Second)
+	resolver.lookup = func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		return []string{"127.0.0.1"}, time.Hour, nil
+	}
+	resolver.mu.Lock()
+	done = resolver.refresh()
+	resolver.mu.Unlock()
+	<-done
+	assert.WithinDuration(t, time.Now().Add(time.Minute), resolver.expires, time.Second)
+}
+
+func TestTTLLookup(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		network := network
+		t.Run(network, func(t *testing.T) {
+			address := startDNSServer(t, network)
+			lookup := &ttlLookup{dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			}}
+			addrs, ttl, err := lookup.LookupHost(context.Background(), "backend.test.")
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"127.0.0.1", "::1"}, addrs)
+			assert.Equal(t, 20*time.Second, ttl)
+
+			addrs, ttl, err = lookup.LookupHost(context.Background(), "127.0.0.1")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"127.0.0.1"}, addrs)
+			assert.Equal(t, time.Duration(0), ttl)
+		})
+	}
+}
+
+// startDNSServer answers A queries with 127.0.0.1 and AAAA queries with ::1, with a TTL of 30s and 20s.
+func startDNSServer(t *testing.T, network string) string {
+	answer := func(query []byte) []byte {
+		var parser dnsmessage.Parser
+		header, err := parser.Start(query)
+		if err != nil {
+			return nil
+		}
+		question, err := parser.Question()
+		if err != nil {
+			return nil
+		}
+		builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true,
+			RecursionDesired: header.RecursionDesired, RecursionAvailable: true})
+		_ = builder.StartQuestions()
+		_ = builder.Question(question)
+		_ = builder.StartAnswers()
+		resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET}
+		switch question.Type {
+		case dnsmessage.TypeA:
+			resource.TTL = 30
+			_ = builder.AResource(resource, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+		case dnsmessage.TypeAAAA:
+			resource.TTL = 20
+			_ = builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}})
+		}
+		msg, _ := builder.Finish()
+		return msg
+	}
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				_, _ = conn.WriteTo(answer(buf[:n]), addr)
+			}
+		}()
+		return conn.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size [2]byte
+					if _, err := io.ReadFull(conn, size[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(size[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					msg := answer(query)
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHostResolverDialFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	resolver := newHostResolver("backend", time.Minute)
+	resolver.lookup = func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		return []string{"127.0.0.2", "127.0.0.1"}, 0, nil
+	}
+	conn, err := resolver.DialContext(context.Background(), &net.Dialer{}, "tcp", l.Addr().(*net.TCPAddr).Port)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+}
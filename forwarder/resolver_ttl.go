@@ -0,0 +1,125 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolveMinTTL is the shortest time addresses are cached, so that records with a TTL of 0 do not cause a lookup on
+// every dial.
+const resolveMinTTL = time.Second
+
+// ttlLookup resolves hosts like net.DefaultResolver and also reports the lowest TTL of the DNS answers, which
+// net.Resolver does not expose. The TTLs are read from the responses passing through the connections to the DNS
+// servers, so that /etc/resolv.conf, search domains and /etc/hosts are still handled by the standard library.
+type ttlLookup struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// LookupHost returns the addresses of host and how long they may be cached. The TTL is 0 if it is not known, e.g.
+// for IP literals and hosts from /etc/hosts.
+func (o *ttlLookup) LookupHost(ctx context.Context, host string) ([]string, time.Duration, error) {
+	var (
+		mu    sync.Mutex
+		ttl   uint32
+		found bool
+	)
+	record := func(msg []byte) {
+		answerTTL, ok := parseAnswerTTL(msg)
+		if !ok {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !found || answerTTL < ttl {
+			ttl = answerTTL
+			found = true
+		}
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := o.dial(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// net.Resolver tells datagrams from streams by net.PacketConn
+			if udpConn, ok := conn.(*net.UDPConn); ok {
+				return &ttlPacketConn{UDPConn: udpConn, record: record}, nil
+			}
+			return &ttlStreamConn{Conn: conn, record: record}, nil
+		},
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil || !found {
+		return addrs, 0, err
+	}
+	return addrs, max(time.Duration(ttl)*time.Second, resolveMinTTL), nil
+}
+
+// parseAnswerTTL returns the lowest TTL of the answers in a DNS response, and false if there are none.
+func parseAnswerTTL(msg []byte) (uint32, bool) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(msg); err != nil {
+		return 0, false
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for {
+		header, err := parser.AnswerHeader()
+		if err != nil {
+			return ttl, found
+		}
+		if !found || header.TTL < ttl {
+			ttl = header.TTL
+			found = true
+		}
+		if err := parser.SkipAnswer(); err != nil {
+			return ttl, found
+		}
+	}
+}
+
+// ttlPacketConn passes every datagram read from a DNS server to record.
+type ttlPacketConn struct {
+	*net.UDPConn
+	record func(msg []byte)
+}
+
+func (o *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := o.UDPConn.Read(b)
+	if n > 0 {
+		o.record(b[:n])
+	}
+	return n, err
+}
+
+// ttlStreamConn passes every length-prefixed message read from a DNS server to record.
+type ttlStreamConn struct {
+	net.Conn
+	record func(msg []byte)
+	buf    []byte
+}
+
+func (o *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := o.Conn.Read(b)
+	o.buf = append(o.buf, b[:n]...)
+	for len(o.buf) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(o.buf))
+		if len(o.buf) < size {
+			break
+		}
+		o.record(o.buf[2:size])
+		o.buf = o.buf[size:]
+	}
+	return n, err
+}
@@ -0,0 +1,239 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/samber/lo"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+)
+
+// SOCKS5 as specified by RFC 1928, with username/password authentication from RFC 1929.
+const (
+	socks5Version         = 5
+	socks5AuthVersion     = 1
+	socks5MethodNoAuth    = 0
+	socks5MethodPassword  = 2
+	socks5MethodNone      = 0xff
+	socks5CommandConnect  = 1
+	socks5AddrIPv4        = 1
+	socks5AddrDomain      = 3
+	socks5AddrIPv6        = 4
+	socks5ReplySucceeded  = 0
+	socks5ReplyFailure    = 1
+	socks5ReplyNotAllowed = 2
+	socks5ReplyRefused    = 5
+	socks5ReplyCommand    = 7
+	socks5ReplyAddrType   = 8
+)
+
+// socks5Connect asks the SOCKS5 server on conn to connect to address, authenticating as user if it is set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	methods := []byte{socks5MethodNoAuth}
+	if user != nil {
+		methods = []byte{socks5MethodPassword}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("not a socks5 server")
+	}
+	switch reply[1] {
+	case socks5MethodNoAuth:
+	case socks5MethodPassword:
+		if user == nil {
+			return errors.New("socks5 server requires authentication")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("socks5 username or password is too long")
+		}
+		request := []byte{socks5AuthVersion, byte(len(user.Username()))}
+		request = append(request, user.Username()...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5 authentication failed")
+		}
+	default:
+		return errors.New("no acceptable socks5 authentication method")
+	}
+	addr, err := appendSOCKS5Addr([]byte{socks5Version, socks5CommandConnect, 0}, address)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(addr); err != nil {
+		return err
+	}
+	reply = make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks5ReplySucceeded {
+		return fmt.Errorf("socks5 connect failed with reply %d", reply[1])
+	}
+	_, err = readSOCKS5Addr(conn)
+	return err
+}
+
+func appendSOCKS5Addr(b []byte, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.Unmap()
+		b = append(b, lo.Ternary[byte](addr.Is4(), socks5AddrIPv4, socks5AddrIPv6))
+		b = append(b, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 host name is too long")
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSOCKS5Addr reads an address type, address and port, and returns them as host:port.
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", err
+	}
+	var host string
+	switch addrType[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, lo.Ternary(addrType[0] == socks5AddrIPv4, 4, 16))
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errSOCKS5AddrType
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+var errSOCKS5AddrType = errors.New("unsupported socks5 address type")
+
+// socks5Accept runs the server side of a SOCKS5 handshake on conn up to the CONNECT request. It returns the
+// authenticated user, which is empty if users is, and the requested destination as host:port.
+func socks5Accept(conn net.Conn, users map[string]string) (user string, address string, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5Version {
+		return "", "", errors.New("not a socks5 client")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	method := byte(lo.Ternary(len(users) == 0, socks5MethodNoAuth, socks5MethodPassword))
+	if !lo.Contains(methods, method) {
+		conn.Write([]byte{socks5Version, socks5MethodNone})
+		return "", "", errors.New("no acceptable socks5 authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", "", err
+	}
+	if method == socks5MethodPassword {
+		if user, err = socks5Authenticate(conn, users); err != nil {
+			return "", "", err
+		}
+	}
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", "", err
+	}
+	if request[0] != socks5Version {
+		return "", "", errors.New("not a socks5 request")
+	}
+	if request[1] != socks5CommandConnect {
+		socks5Reply(conn, socks5ReplyCommand, nil)
+		return "", "", fmt.Errorf("unsupported socks5 command %d", request[1])
+	}
+	address, err = readSOCKS5Addr(conn)
+	if errors.Is(err, errSOCKS5AddrType) {
+		socks5Reply(conn, socks5ReplyAddrType, nil)
+	}
+	return user, address, err
+}
+
+func socks5Authenticate(conn net.Conn, users map[string]string) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5AuthVersion {
+		return "", errors.New("unsupported socks5 authentication version")
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if !checkUser(users, string(username), string(password)) {
+		conn.Write([]byte{socks5AuthVersion, 1})
+		return "", errors.New("socks5 authentication failed for user " + string(username))
+	}
+	_, err := conn.Write([]byte{socks5AuthVersion, 0})
+	return string(username), err
+}
+
+// socks5Reply answers a CONNECT request. bound is the local address of the connection to the destination, if
+// there is one.
+func socks5Reply(conn net.Conn, reply byte, bound net.Addr) error {
+	address := "0.0.0.0:0"
+	if bound != nil {
+		address = bound.String()
+	}
+	b, err := appendSOCKS5Addr([]byte{socks5Version, reply, 0}, address)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
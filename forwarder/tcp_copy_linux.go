@@ -0,0 +1,19 @@
+package forwarder
+
+import (
+	"net"
+)
+
+// copyConn copies from src to dst until EOF or an error. Between two TCP sockets the data is moved by splice(2)
+// inside the kernel, without copying it through user space.
+func copyConn(dst net.Conn, src net.Conn) (int64, error) {
+	dstTCP, ok := dst.(*net.TCPConn)
+	if !ok {
+		return copyBuffered(dst, src)
+	}
+	srcTCP, ok := src.(*net.TCPConn)
+	if !ok {
+		return copyBuffered(dst, src)
+	}
+	return dstTCP.ReadFrom(srcTCP)
+}
@@ -0,0 +1,79 @@
+package forwarder
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// BenchmarkRelayTCP measures the throughput and CPU time of moving data from a client to a backend through the
+// relay, against the loops it replaced: io.Copy between the two TCP connections, as HostForwarder used to do, and
+// io.Copy over a reader that replays peeked bytes, as SNI passthrough used to do.
+func BenchmarkRelayTCP(b *testing.B) {
+	const chunkSize = 1024 * 1024
+	relays := map[string]func(clientSide net.Conn, backendSide net.Conn){
+		"io.Copy": func(clientSide net.Conn, backendSide net.Conn) {
+			go func() {
+				io.Copy(backendSide, clientSide)
+				backendSide.Close()
+			}()
+		},
+		"io.Copy-peeked": func(clientSide net.Conn, backendSide net.Conn) {
+			go func() {
+				io.Copy(backendSide, io.MultiReader(&emptyReader{}, clientSide))
+				backendSide.Close()
+			}()
+		},
+		"relay": func(clientSide net.Conn, backendSide net.Conn) {
+			relayTCP(clientSide, nil, backendSide, 0)
+		},
+		"relay-idle-timeout": func(clientSide net.Conn, backendSide net.Conn) {
+			relayTCP(clientSide, nil, backendSide, time.Minute)
+		},
+	}
+	for _, name := range []string{"io.Copy", "io.Copy-peeked", "relay", "relay-idle-timeout"} {
+		b.Run(name, func(b *testing.B) {
+			client, clientSide := tcpPair(b)
+			backend, backendSide := tcpPair(b)
+			relays[name](clientSide, backendSide)
+			received := &atomic.Int64{}
+			done := make(chan struct{})
+			go func() {
+				n, _ := io.Copy(io.Discard, backend)
+				received.Store(n)
+				close(done)
+			}()
+			chunk := make([]byte, chunkSize)
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			cpuBefore := cpuTime(b)
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			client.(*net.TCPConn).CloseWrite()
+			<-done
+			b.StopTimer()
+			b.ReportMetric(float64((cpuTime(b)-cpuBefore).Nanoseconds())/float64(b.N), "cpu-ns/op")
+			if received.Load() != int64(b.N)*chunkSize {
+				b.Fatalf("received %d bytes, want %d", received.Load(), int64(b.N)*chunkSize)
+			}
+		})
+	}
+}
+
+type emptyReader struct{}
+
+func (emptyReader) Read(p []byte) (int, error) { return 0, io.EOF }
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package forwarder
+
+import (
+	"net"
+)
+
+// copyConn copies from src to dst until EOF or an error.
+func copyConn(dst net.Conn, src net.Conn) (int64, error) {
+	return copyBuffered(dst, src)
+}
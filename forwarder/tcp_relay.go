@@ -0,0 +1,139 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/juzeon/epok-forwarder/data"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dialBackoff is the delay before the first retry of a failed dial. It doubles on every further retry up to
+// maxDialBackoff.
+const (
+	dialBackoff    = 200 * time.Millisecond
+	maxDialBackoff = 5 * time.Second
+)
+
+// dialTCP connects to port on a host with dial, retrying with backoff as configured by options.
+func dialTCP(ctx context.Context, dial data.DialFunc, port int, options data.ForwardTCP) (net.Conn, error) {
+	backoff := dialBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := dial(ctx, port)
+		if err == nil {
+			setTCPOptions(conn, options)
+			return conn, nil
+		}
+		if attempt >= options.Retries {
+			return nil, err
+		}
+		slog.Warn("Cannot dial tcp, retry", "port", port, "attempt", attempt+1, "backoff", backoff,
+			"error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDialBackoff)
+	}
+}
+
+// setTCPOptions applies the keepalive and TCP_NODELAY settings of options to an accepted or dialed connection.
+func setTCPOptions(conn net.Conn, options data.ForwardTCP) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if options.KeepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+	} else if options.KeepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(options.KeepAlive)
+	}
+	if options.NoDelay != nil {
+		tcpConn.SetNoDelay(*options.NoDelay)
+	}
+}
+
+// relayTCP copies between the client and the backend in both directions. A direction that reaches EOF is
+// half-closed on the other side so that the opposite direction can still finish, and both connections are closed
+// once both directions are done or either one fails. peeked is data already read from the client, which is sent to
+// the backend first. If idleTimeout is set, the connections are closed once neither direction has carried data for
+// that long.
+func relayTCP(clientConn net.Conn, peeked []byte, backendConn net.Conn, idleTimeout time.Duration) {
+	lastActive := &atomic.Int64{}
+	lastActive.Store(time.Now().UnixNano())
+	finished := &atomic.Int32{}
+	relay := func(dst net.Conn, src net.Conn, peeked []byte) {
+		if len(peeked) != 0 {
+			if _, err := dst.Write(peeked); err != nil {
+				clientConn.Close()
+				backendConn.Close()
+				return
+			}
+		}
+		if copyTCP(dst, src, idleTimeout, lastActive) == nil && closeWrite(dst) == nil && finished.Add(1) < 2 {
+			return
+		}
+		clientConn.Close()
+		backendConn.Close()
+	}
+	go relay(clientConn, backendConn, nil)
+	go relay(backendConn, clientConn, peeked)
+}
+
+// copyTCP copies from src to dst until EOF. If idleTimeout is set, the copy is interrupted every half of it to
+// check lastActive, which is shared by both directions of a relay, and fails once neither carried data for
+// idleTimeout. Reading with a deadline instead of wrapping src keeps the splice path of copyConn.
+func copyTCP(dst net.Conn, src net.Conn, idleTimeout time.Duration, lastActive *atomic.Int64) error {
+	for {
+		if idleTimeout > 0 {
+			if err := src.SetReadDeadline(time.Now().Add(idleTimeout / 2)); err != nil {
+				return err
+			}
+		}
+		n, err := copyConn(dst, src)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+		}
+		if idleTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) &&
+			time.Since(time.Unix(0, lastActive.Load())) < idleTimeout {
+			continue
+		}
+		return err
+	}
+}
+
+const tcpBufferSize = 32 * 1024
+
+var tcpBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, tcpBufferSize)
+		return &buf
+	},
+}
+
+// copyBuffered copies from src to dst through a pooled buffer. Both sides are wrapped so that io.CopyBuffer
+// cannot hand the copy to a ReadFrom or WriteTo method that allocates its own buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := tcpBufferPool.Get().(*[]byte)
+	defer tcpBufferPool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// closeWrite shuts down the writing side of conn, or reports an error if conn cannot be half-closed.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func dialLoopback(ctx context.Context, port int) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	accepted, err := l.Accept()
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func TestDialTCPRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	options := data.ForwardTCP{ConnectTimeout: time.Second}
+	_, err = dialTCP(context.Background(), dialLoopback, port, options)
+	assert.Error(t, err)
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+	}()
+	options.Retries = 5
+	conn, err := dialTCP(context.Background(), dialLoopback, port, options)
+	assert.NoError(t, err)
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func TestRelayTCPIdleTimeout(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	backend, backendSide := tcpPair(t)
+	relayTCP(clientSide, nil, backendSide, time.Second)
+	buf := make([]byte, 5)
+	// Each write comes well within the idle timeout of the previous one
+	for i := 0; i < 3; i++ {
+		time.Sleep(400 * time.Millisecond)
+		_, err := client.Write([]byte("hello"))
+		assert.NoError(t, err)
+		_, err = io.ReadFull(backend, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", string(buf))
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err := client.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestRelayTCPHalfClose(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	backend, backendSide := tcpPair(t)
+	relayTCP(clientSide, nil, backendSide, 0)
+	_, err := client.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, client.(*net.TCPConn).CloseWrite())
+	b, err := io.ReadAll(backend)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+	for _, msg := range []string{"pong", "pong again"} {
+		_, err = backend.Write([]byte(msg))
+		assert.NoError(t, err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(client, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+	assert.NoError(t, backend.Close())
+	b, err = io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+}
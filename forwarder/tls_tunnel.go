@@ -0,0 +1,60 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/juzeon/epok-forwarder/data"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake with a client of a forward that terminates TLS.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// acceptTLS runs the server side of a TLS handshake on conn.
+func acceptTLS(ctx context.Context, conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Server(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// prefixConn is a net.Conn that reads prefix, data already read from Conn, before the rest of Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (o *prefixConn) Read(b []byte) (int, error) {
+	if len(o.prefix) != 0 {
+		n := copy(b, o.prefix)
+		o.prefix = o.prefix[n:]
+		return n, nil
+	}
+	return o.Conn.Read(b)
+}
+
+// withBackendTLS wraps dial to originate TLS over the connections it makes. timeout bounds the handshake.
+func withBackendTLS(dial data.DialFunc, config *tls.Config, timeout time.Duration) data.DialFunc {
+	return func(ctx context.Context, port int) (net.Conn, error) {
+		conn, err := dial(ctx, port)
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("backend tls: %w", err)
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,142 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes cert and its key as PEM files to a temporary directory and returns their paths.
+func writeTestCertificate(t testing.TB, cert tls.Certificate) (string, string) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+	return certFile, keyFile
+}
+
+// startTLSForward forwards a free port of 127.0.0.1 to backend with forwardTLS and returns the listening address.
+func startTLSForward(t testing.TB, forwardTLS data.ForwardTLS, backend net.Listener) string {
+	forward := data.Forward{
+		Type:        data.ForwardTypePort,
+		Bind:        "127.0.0.1",
+		ForwardPort: data.ForwardPort{Src: freePort(t), Dst: backend.Addr().(*net.TCPAddr).Port},
+		ForwardTLS:  forwardTLS,
+	}
+	assert.NoError(t, forward.Validate())
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		waitGroup.Wait()
+	})
+	_, err := NewHostForwarder(ctx, data.BaseConfig{}, data.Host{Host: "127.0.0.1", Forwards: []data.Forward{forward}},
+		nil, waitGroup)
+	assert.NoError(t, err)
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(forward.ForwardPort.Src))
+}
+
+// pingTLS sends "ping" to addr over TLS, half-closes and returns everything read back.
+func pingTLS(t testing.TB, addr string, config *tls.Config) string {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return ""
+	}
+	assert.NoError(t, conn.CloseWrite())
+	reply, _ := io.ReadAll(conn)
+	return string(reply)
+}
+
+func TestTLSTunnel(t *testing.T) {
+	backendCert := newTestCertificate(t, "backend.test")
+	backendCA, _ := writeTestCertificate(t, backendCert)
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{backendCert}})
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	frontendCert := newTestCertificate(t, "frontend.test")
+	certFile, keyFile := writeTestCertificate(t, frontendCert)
+	roots := x509.NewCertPool()
+	roots.AddCert(frontendCert.Leaf)
+	clientConfig := &tls.Config{RootCAs: roots, ServerName: "frontend.test"}
+	forwardTLS := data.ForwardTLS{
+		TLSCert:           certFile,
+		TLSKey:            keyFile,
+		BackendTLS:        true,
+		BackendCA:         backendCA,
+		BackendServerName: "backend.test",
+	}
+	assert.Equal(t, "got:ping", pingTLS(t, startTLSForward(t, forwardTLS, backend), clientConfig))
+
+	// A backend that does not match backend_server_name is refused
+	forwardTLS.BackendServerName = "other.test"
+	assert.Empty(t, pingTLS(t, startTLSForward(t, forwardTLS, backend), clientConfig))
+}
+
+func TestTLSTunnelClientAuth(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	serverCert := newTestCertificate(t, "frontend.test")
+	certFile, keyFile := writeTestCertificate(t, serverCert)
+	alice := newTestCertificate(t, "alice.clients.test")
+	bob := newTestCertificate(t, "bob.clients.test")
+	mallory := newTestCertificate(t, "mallory.test")
+	dir := t.TempDir()
+	clientCA := filepath.Join(dir, "ca.pem")
+	var cas []byte
+	for _, cert := range []tls.Certificate{alice, bob, mallory} {
+		cas = append(cas, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})...)
+	}
+	assert.NoError(t, os.WriteFile(clientCA, cas, 0600))
+	// bob is self-signed, so bob revokes itself
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: bob.Leaf.SerialNumber, RevocationTime: time.Now()},
+		},
+	}, bob.Leaf, bob.PrivateKey.(*ecdsa.PrivateKey))
+	assert.NoError(t, err)
+	clientCRL := filepath.Join(dir, "crl.pem")
+	assert.NoError(t, os.WriteFile(clientCRL, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600))
+	addr := startTLSForward(t, data.ForwardTLS{
+		TLSCert:     certFile,
+		TLSKey:      keyFile,
+		ClientCA:    clientCA,
+		ClientNames: "*.clients.test",
+		ClientCRL:   clientCRL,
+	}, backend)
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	ping := func(certs ...tls.Certificate) string {
+		return pingTLS(t, addr, &tls.Config{RootCAs: roots, ServerName: "frontend.test", Certificates: certs})
+	}
+	assert.Equal(t, "got:ping", ping(alice))
+	assert.Empty(t, ping())
+	assert.Empty(t, ping(bob))
+	assert.Empty(t, ping(mallory))
+	assert.Empty(t, ping(newTestCertificate(t, "eve.clients.test")))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTransparent(network string, address string) (net.Listener, error) {
+	return nil, errors.New("tproxy is only supported on linux")
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package forwarder
+
+import (
+	"net"
+	"net/netip"
+)
+
+func readFromUDP(conn *net.UDPConn, handle func(packet []byte, addr netip.AddrPort)) error {
+	buf := udpBufferPool.Get().(*[]byte)
+	defer udpBufferPool.Put(buf)
+	n, addr, err := conn.ReadFromUDPAddrPort(*buf)
+	if err != nil {
+		return err
+	}
+	handle((*buf)[:n], addr)
+	return nil
+}
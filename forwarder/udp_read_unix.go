@@ -0,0 +1,47 @@
+//go:build unix
+
+package forwarder
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// readFromUDP reads one packet from conn and passes it to handle. The buffer is only taken from the pool once
+// the socket is readable, so the many idle sockets of a port range don't each pin a 64 KiB buffer.
+func readFromUDP(conn *net.UDPConn, handle func(packet []byte, addr netip.AddrPort)) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var readErr error
+	err = rawConn.Read(func(fd uintptr) bool {
+		buf := udpBufferPool.Get().(*[]byte)
+		defer udpBufferPool.Put(buf)
+		n, from, err := syscall.Recvfrom(int(fd), *buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+			return false
+		}
+		if err != nil {
+			readErr = err
+			return true
+		}
+		handle((*buf)[:n], sockaddrToAddrPort(from))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+func sockaddrToAddrPort(sa syscall.Sockaddr) netip.AddrPort {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), uint16(sa.Port))
+	case *syscall.SockaddrInet6:
+		return netip.AddrPortFrom(netip.AddrFrom16(sa.Addr), uint16(sa.Port))
+	}
+	return netip.AddrPort{}
+}
@@ -0,0 +1,231 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"github.com/juzeon/epok-forwarder/data"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const udpBufferSize = 64 * 1024
+
+// maxDeniedUDPClients bounds the clients denied by the firewall that a relay remembers until they expire, so that
+// their packets are dropped without checking the firewall again. They don't count towards udp_max_sessions.
+const maxDeniedUDPClients = 1024
+
+var udpBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, udpBufferSize)
+		return &buf
+	},
+}
+
+// udpRelay forwards datagrams between clients of a listening socket and a destination. Each client address gets
+// its own upstream socket, so replies can be sent back to the right client.
+type udpRelay struct {
+	ctx           context.Context
+	conn          *net.UDPConn
+	resolver      *hostResolver
+	dialer        contextDialer
+	dstPort       int
+	firewallArray data.FirewallArray
+	options       data.ForwardUDP
+	sessions      map[netip.AddrPort]*udpSession
+	// denied holds the sessions of clients denied by the firewall, which have no upstream
+	denied map[netip.AddrPort]*udpSession
+	mu     sync.Mutex
+}
+
+type udpSession struct {
+	clientAddr netip.AddrPort
+	// upstream is nil if the flow is denied. Its packets are dropped until the session expires.
+	upstream   *net.UDPConn
+	started    time.Time
+	lastActive atomic.Int64
+	packetsIn  atomic.Uint64
+	packetsOut atomic.Uint64
+	bytesIn    atomic.Uint64
+	bytesOut   atomic.Uint64
+}
+
+func newUDPRelay(ctx context.Context, conn *net.UDPConn, resolver *hostResolver, dialer contextDialer, dstPort int,
+	firewallArray data.FirewallArray, options data.ForwardUDP) *udpRelay {
+	return &udpRelay{
+		ctx:           ctx,
+		conn:          conn,
+		resolver:      resolver,
+		dialer:        dialer,
+		dstPort:       dstPort,
+		firewallArray: firewallArray,
+		options:       options,
+		sessions:      map[netip.AddrPort]*udpSession{},
+		denied:        map[netip.AddrPort]*udpSession{},
+	}
+}
+
+// Serve relays packets until the listening socket is closed. Idle sessions are dropped by calls to expireSessions.
+func (o *udpRelay) Serve() {
+	for {
+		err := readFromUDP(o.conn, o.handlePacket)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			slog.Warn("Cannot read udp packet", "error", err)
+		}
+	}
+	o.closeSessions(func(session *udpSession) bool { return true })
+}
+
+func (o *udpRelay) handlePacket(packet []byte, clientAddr netip.AddrPort) {
+	session := o.getSession(clientAddr)
+	if session == nil {
+		return
+	}
+	session.write(packet)
+}
+
+// getSession returns the session of clientAddr, or creates it unless the client is denied. Sessions are only created
+// from the Serve goroutine, so the upstream is dialed without holding mu, which would hold up GetFlows and expiry.
+func (o *udpRelay) getSession(clientAddr netip.AddrPort) *udpSession {
+	o.mu.Lock()
+	session, ok := o.sessions[clientAddr]
+	_, denied := o.denied[clientAddr]
+	sessions := len(o.sessions)
+	o.mu.Unlock()
+	if ok {
+		return session
+	}
+	if denied {
+		return nil
+	}
+	session = &udpSession{clientAddr: clientAddr, started: time.Now()}
+	session.lastActive.Store(session.started.UnixNano())
+	allow, reason := o.firewallArray.CheckAllowAddr(clientAddr.Addr())
+	if !allow {
+		slog.Warn("Deny udp flow", "client", clientAddr.String(), "reason", reason)
+		o.mu.Lock()
+		if len(o.denied) < maxDeniedUDPClients {
+			o.denied[clientAddr] = session
+		}
+		o.mu.Unlock()
+		return nil
+	}
+	if o.options.UDPMaxSessions != 0 && sessions >= o.options.UDPMaxSessions {
+		slog.Warn("Drop udp flow due to too many sessions", "client", clientAddr.String(),
+			"max", o.options.UDPMaxSessions)
+		return nil
+	}
+	upstream, err := o.resolver.DialContext(o.ctx, o.dialer, "udp", o.dstPort)
+	if err != nil {
+		slog.Warn("Cannot dial udp", "error", err)
+		return nil
+	}
+	slog.Info("Accept udp flow", "client", clientAddr.String(), "dst", upstream.RemoteAddr().String(),
+		"reason", reason)
+	session.upstream = upstream.(*net.UDPConn)
+	o.mu.Lock()
+	o.sessions[clientAddr] = session
+	o.mu.Unlock()
+	go session.relayReplies(o.conn)
+	return session
+}
+
+// write sends a packet of the client upstream.
+func (o *udpSession) write(packet []byte) {
+	o.lastActive.Store(time.Now().UnixNano())
+	o.packetsIn.Add(1)
+	o.bytesIn.Add(uint64(len(packet)))
+	if _, err := o.upstream.Write(packet); err != nil {
+		slog.Warn("Cannot write udp packet", "error", err)
+	}
+}
+
+// relayReplies sends the replies read from upstream to the client through conn until upstream is closed. The
+// refused reads a connected socket reports while the backend is down are skipped, so that replies resume once it is
+// back.
+func (o *udpSession) relayReplies(conn *net.UDPConn) {
+	for {
+		err := readFromUDP(o.upstream, func(packet []byte, addr netip.AddrPort) {
+			o.lastActive.Store(time.Now().UnixNano())
+			o.packetsOut.Add(1)
+			o.bytesOut.Add(uint64(len(packet)))
+			if _, err := conn.WriteToUDPAddrPort(packet, o.clientAddr); err != nil {
+				slog.Warn("Cannot write udp reply", "error", err)
+			}
+		})
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			slog.Debug("Backend refused udp packet", "client", o.clientAddr.String(),
+				"dst", o.upstream.RemoteAddr().String())
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Cannot read udp reply", "error", err)
+			}
+			return
+		}
+	}
+}
+
+// getFlow describes the session for the listening socket listen. dst is reported unless the session has an upstream.
+func (o *udpSession) getFlow(listen string, dst string, denied bool) data.UDPFlow {
+	if o.upstream != nil {
+		dst = o.upstream.RemoteAddr().String()
+	}
+	return data.UDPFlow{
+		Listen:     listen,
+		Client:     o.clientAddr.String(),
+		Dst:        dst,
+		Denied:     denied,
+		PacketsIn:  o.packetsIn.Load(),
+		PacketsOut: o.packetsOut.Load(),
+		BytesIn:    o.bytesIn.Load(),
+		BytesOut:   o.bytesOut.Load(),
+		Started:    o.started,
+		LastActive: time.Unix(0, o.lastActive.Load()),
+	}
+}
+
+func (o *udpRelay) expireSessions(now time.Time) {
+	deadline := now.Add(-o.options.UDPTimeout).UnixNano()
+	o.closeSessions(func(session *udpSession) bool {
+		return session.lastActive.Load() < deadline
+	})
+}
+
+func (o *udpRelay) closeSessions(filter func(session *udpSession) bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, sessions := range []map[netip.AddrPort]*udpSession{o.sessions, o.denied} {
+		for clientAddr, session := range sessions {
+			if !filter(session) {
+				continue
+			}
+			if session.upstream != nil {
+				session.upstream.Close()
+			}
+			delete(sessions, clientAddr)
+		}
+	}
+}
+
+func (o *udpRelay) GetFlows() []data.UDPFlow {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var flows []data.UDPFlow
+	for _, sessions := range []map[netip.AddrPort]*udpSession{o.sessions, o.denied} {
+		for _, session := range sessions {
+			flows = append(flows, session.getFlow(o.conn.LocalAddr().String(),
+				net.JoinHostPort(o.resolver.host, strconv.Itoa(o.dstPort)), session.upstream == nil))
+		}
+	}
+	return flows
+}
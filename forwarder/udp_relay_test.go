@@ -0,0 +1,168 @@
+package forwarder
+
+import (
+	"context"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	return listenUDPEcho(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+}
+
+// listenUDPEcho answers every packet received on addr with the packet itself.
+func listenUDPEcho(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", addr)
+	assert.NoError(t, err)
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func startUDPRelay(t *testing.T, dst string, firewallArray data.FirewallArray, options data.ForwardUDP) *udpRelay {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	host, port, err := net.SplitHostPort(dst)
+	assert.NoError(t, err)
+	dstPort, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+	relay := newUDPRelay(ctx, conn, newHostResolver(host, time.Minute), &net.Dialer{}, dstPort, firewallArray, options)
+	go relay.Serve()
+	t.Cleanup(func() {
+		cancel()
+		conn.Close()
+	})
+	return relay
+}
+
+func exchangeUDP(t *testing.T, addr net.Addr, msg string) (string, error) {
+	conn, err := net.Dial("udp", addr.String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(msg))
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, udpBufferSize)
+	n, err := conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func TestUDPRelayFirewall(t *testing.T) {
+	echo := startUDPEcho(t)
+	relay := startUDPRelay(t, echo.LocalAddr().String(), data.FirewallArray{
+		data.Firewall{
+			Allow: "",
+			Deny:  "10.0.0.0/8",
+		},
+	}, data.ForwardUDP{UDPTimeout: time.Minute})
+	reply, err := exchangeUDP(t, relay.conn.LocalAddr(), "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", reply)
+	relay = startUDPRelay(t, echo.LocalAddr().String(), data.FirewallArray{
+		data.Firewall{
+			Allow: "",
+			Deny:  "127.0.0.1",
+		},
+	}, data.ForwardUDP{UDPTimeout: time.Minute})
+	_, err = exchangeUDP(t, relay.conn.LocalAddr(), "hello")
+	assert.Error(t, err)
+}
+
+func TestUDPRelaySessions(t *testing.T) {
+	echo := startUDPEcho(t)
+	relay := startUDPRelay(t, echo.LocalAddr().String(), nil,
+		data.ForwardUDP{UDPTimeout: time.Second, UDPMaxSessions: 1})
+	conn, err := net.Dial("udp", relay.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, udpBufferSize)
+	for _, msg := range []string{"a", "bc"} {
+		_, err = conn.Write([]byte(msg))
+		assert.NoError(t, err)
+		n, err := conn.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+	flows := relay.GetFlows()
+	assert.Len(t, flows, 1)
+	assert.Equal(t, conn.LocalAddr().String(), flows[0].Client)
+	assert.Equal(t, uint64(2), flows[0].PacketsIn)
+	assert.Equal(t, uint64(2), flows[0].PacketsOut)
+	assert.Equal(t, uint64(3), flows[0].BytesIn)
+	assert.Equal(t, uint64(3), flows[0].BytesOut)
+	_, err = exchangeUDP(t, relay.conn.LocalAddr(), "over the limit")
+	assert.Error(t, err)
+	relay.expireSessions(time.Now())
+	assert.Len(t, relay.GetFlows(), 1)
+	time.Sleep(600 * time.Millisecond)
+	relay.expireSessions(time.Now())
+	assert.Len(t, relay.GetFlows(), 0)
+	reply, err := exchangeUDP(t, relay.conn.LocalAddr(), "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", reply)
+}
+
+func TestUDPRelayBackendRestart(t *testing.T) {
+	echo := startUDPEcho(t)
+	relay := startUDPRelay(t, echo.LocalAddr().String(), nil, data.ForwardUDP{UDPTimeout: time.Minute})
+	conn, err := net.Dial("udp", relay.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, udpBufferSize)
+	exchange := func(msg string) (string, error) {
+		_, err := conn.Write([]byte(msg))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+		n, err := conn.Read(buf)
+		return string(buf[:n]), err
+	}
+	reply, err := exchange("before")
+	assert.NoError(t, err)
+	assert.Equal(t, "before", reply)
+	// The packet sent while the backend is down is refused on the upstream socket of the session
+	echo.Close()
+	_, err = exchange("down")
+	assert.Error(t, err)
+	listenUDPEcho(t, echo.LocalAddr().(*net.UDPAddr))
+	reply, err = exchange("after")
+	assert.NoError(t, err)
+	assert.Equal(t, "after", reply)
+	assert.Len(t, relay.GetFlows(), 1)
+}
+
+func TestUDPRelayDeniedSessions(t *testing.T) {
+	echo := startUDPEcho(t)
+	relay := startUDPRelay(t, echo.LocalAddr().String(), data.FirewallArray{data.Firewall{Deny: "127.0.0.2"}},
+		data.ForwardUDP{UDPTimeout: time.Minute, UDPMaxSessions: 1})
+	for i := 0; i < 3; i++ {
+		conn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, relay.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Skip("127.0.0.2 is not a local address:", err)
+		}
+		_, err = conn.Write([]byte("denied"))
+		assert.NoError(t, err)
+		conn.Close()
+	}
+	// Denied clients don't take the only session
+	reply, err := exchangeUDP(t, relay.conn.LocalAddr(), "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", reply)
+	flows := relay.GetFlows()
+	assert.Len(t, flows, 4)
+	assert.Equal(t, 3, lo.CountBy(flows, func(flow data.UDPFlow) bool { return flow.Denied }))
+}
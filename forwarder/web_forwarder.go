@@ -1,7 +1,9 @@
 package forwarder
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"github.com/IGLOU-EU/go-wildcard/v2"
 	"github.com/juzeon/epok-forwarder/data"
 	"github.com/samber/lo"
@@ -22,6 +24,10 @@ type WebForwarder struct {
 	targets        []data.WebForwardTarget
 	reverseProxies sync.Map
 	waitGroup      *sync.WaitGroup
+	// muxHttp accepts the plain http connections detected by handleMuxConn. It is nil unless mux is enabled.
+	muxHttp *connListener
+	// quicRelays are set up once StartAsync is called
+	quicRelays []*quicRelay
 }
 
 func NewWebForwarder(ctx context.Context, baseConfig data.BaseConfig, waitGroup *sync.WaitGroup) (*WebForwarder, error) {
@@ -31,20 +37,48 @@ func NewWebForwarder(ctx context.Context, baseConfig data.BaseConfig, waitGroup
 		targets:        nil,
 		reverseProxies: sync.Map{},
 		waitGroup:      waitGroup,
+		muxHttp:        lo.Ternary(baseConfig.Mux.Enable, newConnListener(), nil),
 	}, nil
 }
-func (o *WebForwarder) RegisterTarget(hostname string, dstIP string, dstHttpPort int, dstHttpsPort int,
-	firewallArray data.FirewallArray) {
-	target := data.WebForwardTarget{
-		Hostname:      hostname,
-		DstIP:         dstIP,
-		DstHttpPort:   dstHttpPort,
-		DstHttpsPort:  dstHttpsPort,
-		FirewallArray: firewallArray,
+
+// RegisterTarget routes a hostname to target. A target without ListenPort is routed on the https port.
+func (o *WebForwarder) RegisterTarget(target data.WebForwardTarget) {
+	if target.ListenPort == 0 {
+		target.ListenPort = o.baseConfig.Https
 	}
 	slog.Info("Register web forwarder", "target", target)
 	o.targets = append(o.targets, target)
 }
+
+// findHttpsTarget picks the target of a TLS client accepted on port. Hostnames are matched against the SNI, and a
+// client without SNI goes to a default target. Among the matching targets, one whose ALPN includes a protocol
+// offered by the client is preferred over one without ALPN, and one whose ALPN includes none of them is skipped.
+func (o *WebForwarder) findHttpsTarget(port int, clientHello *tls.ClientHelloInfo) (data.WebForwardTarget, bool) {
+	var fallback *data.WebForwardTarget
+	for i := range o.targets {
+		target := &o.targets[i]
+		if target.ListenPort != port {
+			continue
+		}
+		if clientHello.ServerName == "" && !target.Default ||
+			clientHello.ServerName != "" && !wildcard.Match(target.Hostname, clientHello.ServerName) {
+			continue
+		}
+		if len(target.ALPN) == 0 {
+			if fallback == nil {
+				fallback = target
+			}
+			continue
+		}
+		if lo.Some(target.ALPN, clientHello.SupportedProtos) {
+			return *target, true
+		}
+	}
+	if fallback == nil {
+		return data.WebForwardTarget{}, false
+	}
+	return *fallback, true
+}
 func (o *WebForwarder) StartAsync() error {
 	if err := o.startHttpAsync(); err != nil {
 		return err
@@ -52,83 +86,150 @@ func (o *WebForwarder) StartAsync() error {
 	if err := o.startHttpsAsync(); err != nil {
 		return err
 	}
+	if o.baseConfig.QUIC {
+		if err := o.startQUICAsync(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
-func (o *WebForwarder) startHttpsAsync() error {
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(o.baseConfig.Https))
-	if err != nil {
-		return err
-	}
-	handleConnection := func(clientConn net.Conn) {
-		streaming := false
-		defer func() {
-			if !streaming {
-				clientConn.Close()
-			}
-		}()
-		if err := clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-			slog.Warn("Cannot set read deadline", "err", err)
-			return
-		}
-		clientHello, clientReader, err := peekClientHello(clientConn)
+
+// startQUICAsync listens on UDP of the https port and routes QUIC clients by SNI.
+func (o *WebForwarder) startQUICAsync() error {
+	for _, listenAddr := range o.baseConfig.Bind.GetListenAddrs("udp", o.baseConfig.Https) {
+		addr, err := net.ResolveUDPAddr(listenAddr.Network, listenAddr.Address)
 		if err != nil {
-			slog.Warn("Cannot peek client hello", "err", err)
-			return
+			return err
 		}
-		if err := clientConn.SetReadDeadline(time.Time{}); err != nil {
-			slog.Warn("Cannot set read deadline", "err", err)
-			return
-		}
-		target, ok := lo.Find(o.targets, func(item data.WebForwardTarget) bool {
-			return wildcard.Match(item.Hostname, clientHello.ServerName)
-		})
-		if !ok {
-			slog.Warn("No hostname matches", "hostname", clientHello.ServerName)
-			return
-		}
-		allow, reason := target.FirewallArray.CheckAllowByAddr(clientConn.RemoteAddr().String())
-		if !allow {
-			slog.Warn("Deny https conn", "reason", reason)
-			return
-		}
-		dest := net.JoinHostPort(target.DstIP, strconv.Itoa(target.DstHttpsPort))
-		slog.Info("Serve https", "dest", dest, "hostname", clientHello.ServerName, "reason", reason)
-		backendConn, err := net.DialTimeout("tcp", dest,
-			5*time.Second)
+		conn, err := net.ListenUDP(listenAddr.Network, addr)
 		if err != nil {
-			slog.Warn("Cannot dial backend", "err", err)
-			return
+			return err
 		}
-		streaming = true
+		o.waitGroup.Add(1)
 		go func() {
-			io.Copy(clientConn, backendConn)
-			clientConn.Close()
-			backendConn.Close()
-		}()
-		go func() {
-			io.Copy(backendConn, clientReader)
-			clientConn.Close()
-			backendConn.Close()
+			<-o.ctx.Done()
+			conn.Close()
+			o.waitGroup.Done()
 		}()
+		relay := newQUICRelay(o.ctx, conn, o)
+		o.quicRelays = append(o.quicRelays, relay)
+		go relay.Serve()
 	}
 	o.waitGroup.Add(1)
 	go func() {
-		<-o.ctx.Done()
-		l.Close()
-		o.waitGroup.Done()
-	}()
-	go func() {
+		defer o.waitGroup.Done()
+		ticker := time.NewTicker(o.baseConfig.ClientHelloTimeout / 2)
+		defer ticker.Stop()
 		for {
-			conn, err := l.Accept()
-			if err != nil {
-				slog.Warn("Cannot accept https conn", "error", err)
-				break
+			select {
+			case <-o.ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, relay := range o.quicRelays {
+					relay.expireSessions(now)
+				}
 			}
-			go handleConnection(conn)
 		}
 	}()
 	return nil
 }
+
+// GetUDPFlows returns the QUIC flows.
+func (o *WebForwarder) GetUDPFlows() []data.UDPFlow {
+	var flows []data.UDPFlow
+	for _, relay := range o.quicRelays {
+		flows = append(flows, relay.GetFlows()...)
+	}
+	return flows
+}
+
+// handleTLSConn routes a TLS client accepted on port by SNI. sniffed is data already read from the client.
+func (o *WebForwarder) handleTLSConn(clientConn net.Conn, sniffed []byte, port int) {
+	streaming := false
+	defer func() {
+		if !streaming {
+			clientConn.Close()
+		}
+	}()
+	if err := clientConn.SetReadDeadline(time.Now().Add(o.baseConfig.ClientHelloTimeout)); err != nil {
+		slog.Warn("Cannot set read deadline", "err", err)
+		return
+	}
+	clientHello, peeked, err := peekClientHello(io.MultiReader(bytes.NewReader(sniffed), clientConn))
+	if err != nil {
+		slog.Warn("Cannot peek client hello", "err", err)
+		return
+	}
+	if err := clientConn.SetReadDeadline(time.Time{}); err != nil {
+		slog.Warn("Cannot set read deadline", "err", err)
+		return
+	}
+	target, ok := o.findHttpsTarget(port, clientHello)
+	if !ok {
+		slog.Warn("No hostname matches", "hostname", clientHello.ServerName, "alpn", clientHello.SupportedProtos,
+			"port", port)
+		return
+	}
+	allow, reason := target.FirewallArray.CheckAllowByAddr(clientConn.RemoteAddr().String())
+	if !allow {
+		slog.Warn("Deny https conn", "reason", reason)
+		return
+	}
+	setTCPOptions(clientConn, target.TCPOptions)
+	if target.TLSConfig != nil {
+		tlsConn, err := acceptTLS(o.ctx, &prefixConn{Conn: clientConn, prefix: peeked}, target.TLSConfig)
+		if err != nil {
+			slog.Warn("Cannot accept tls conn", "client", clientConn.RemoteAddr().String(),
+				"hostname", clientHello.ServerName, "error", err)
+			return
+		}
+		clientConn, peeked = tlsConn, nil
+	}
+	dest := net.JoinHostPort(target.DstHost, strconv.Itoa(target.DstHttpsPort))
+	slog.Info("Serve https", "dest", dest, "hostname", clientHello.ServerName, "reason", reason)
+	backendConn, err := target.Dial(o.ctx, target.DstHttpsPort)
+	if err != nil {
+		slog.Warn("Cannot dial backend", "err", err)
+		return
+	}
+	streaming = true
+	relayTCP(clientConn, peeked, backendConn, target.TCPOptions.IdleTimeout)
+}
+func (o *WebForwarder) startHttpsAsync() error {
+	// The https port is listened on even without targets, and every other port once for all targets routed on it
+	ports := lo.Uniq(append([]int{o.baseConfig.Https},
+		lo.Map(o.targets, func(item data.WebForwardTarget, index int) int { return item.ListenPort })...))
+	for _, port := range ports {
+		port := port
+		for _, listenAddr := range o.baseConfig.Bind.GetListenAddrs("tcp", port) {
+			l, err := net.Listen(listenAddr.Network, listenAddr.Address)
+			if err != nil {
+				return err
+			}
+			o.waitGroup.Add(1)
+			go func() {
+				<-o.ctx.Done()
+				l.Close()
+				o.waitGroup.Done()
+			}()
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						slog.Warn("Cannot accept https conn", "error", err)
+						break
+					}
+					if o.muxHttp != nil {
+						go o.handleMuxConn(conn, port)
+					} else {
+						go o.handleTLSConn(conn, nil, port)
+					}
+				}
+			}()
+		}
+	}
+	return nil
+}
 func (o *WebForwarder) startHttpAsync() error {
 	handleErr := func(writer http.ResponseWriter, msg string) {
 		writer.Header().Set("Content-Type", "text/plain")
@@ -140,8 +241,8 @@ func (o *WebForwarder) startHttpAsync() error {
 		WriteTimeout: 20 * time.Second,
 		IdleTimeout:  120 * time.Second,
 		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-			target, ok := lo.Find(o.targets, func(item data.WebForwardTarget) bool {
-				return wildcard.Match(item.Hostname, request.Host)
+			target, index, ok := lo.FindIndexOf(o.targets, func(item data.WebForwardTarget) bool {
+				return item.ListenPort == o.baseConfig.Https && wildcard.Match(item.Hostname, request.Host)
 			})
 			if !ok {
 				handleErr(writer, "no hostname matches "+request.Host)
@@ -152,20 +253,36 @@ func (o *WebForwarder) startHttpAsync() error {
 				slog.Warn("Deny http conn", "reason", reason)
 				return
 			}
-			dest := "http://" + net.JoinHostPort(target.DstIP, strconv.Itoa(target.DstHttpPort))
+			if target.TLSConfig != nil && target.TLSConfig.ClientCAs != nil {
+				// Plain http cannot carry the client certificate the hostname requires
+				slog.Warn("Deny http conn", "reason", "client certificate required", "hostname", request.Host)
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			dest := "http://" + net.JoinHostPort(target.DstHost, strconv.Itoa(target.DstHttpPort))
 			u, err := url.Parse(dest)
 			if err != nil {
 				handleErr(writer, err.Error())
 				return
 			}
-			r := httputil.NewSingleHostReverseProxy(u)
-			originalDirector := r.Director
-			r.Director = func(request *http.Request) {
-				originalDirector(request)
-				request.Host = target.Hostname
+			// Every target has its own reverse proxy, since targets of the same backend may dial it differently
+			actualR, ok := o.reverseProxies.Load(index)
+			if !ok {
+				r := httputil.NewSingleHostReverseProxy(u)
+				// Dial through the target so that the backend is re-resolved and every address is tried
+				transport := http.DefaultTransport.(*http.Transport).Clone()
+				transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return target.Dial(ctx, target.DstHttpPort)
+				}
+				r.Transport = transport
+				originalDirector := r.Director
+				r.Director = func(request *http.Request) {
+					originalDirector(request)
+					request.Host = target.Hostname
+				}
+				actualR, _ = o.reverseProxies.LoadOrStore(index, r)
 			}
-			actualR, _ := o.reverseProxies.LoadOrStore(dest, r)
-			r = actualR.(*httputil.ReverseProxy)
+			r := actualR.(*httputil.ReverseProxy)
 			slog.Info("Serve http", "dest", dest, "hostname", target.Hostname, "reason", reason)
 			r.ServeHTTP(writer, request)
 		}),
@@ -173,21 +290,46 @@ func (o *WebForwarder) startHttpAsync() error {
 			return o.ctx
 		},
 	}
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(o.baseConfig.Http))
-	if err != nil {
-		return err
-	}
-	o.waitGroup.Add(1)
-	go func() {
-		<-o.ctx.Done()
-		l.Close()
-		o.waitGroup.Done()
-	}()
-	go func() {
-		err = server.Serve(l)
+	for _, listenAddr := range o.baseConfig.Bind.GetListenAddrs("tcp", o.baseConfig.Http) {
+		l, err := net.Listen(listenAddr.Network, listenAddr.Address)
 		if err != nil {
-			slog.Warn("Cannot accept web", "error", err)
+			return err
 		}
-	}()
+		o.waitGroup.Add(1)
+		go func() {
+			<-o.ctx.Done()
+			l.Close()
+			o.waitGroup.Done()
+		}()
+		if o.muxHttp != nil {
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						slog.Warn("Cannot accept web", "error", err)
+						break
+					}
+					go o.handleMuxConn(conn, o.baseConfig.Http)
+				}
+			}()
+			continue
+		}
+		go func() {
+			err := server.Serve(l)
+			if err != nil {
+				slog.Warn("Cannot accept web", "error", err)
+			}
+		}()
+	}
+	if o.muxHttp != nil {
+		// Plain http sniffed on any port is served here
+		o.waitGroup.Add(1)
+		go func() {
+			<-o.ctx.Done()
+			o.muxHttp.Close()
+			o.waitGroup.Done()
+		}()
+		go server.Serve(o.muxHttp)
+	}
 	return nil
 }
@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/juzeon/epok-forwarder/data"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCertificate issues a self-signed certificate for hostnames.
+func newTestCertificate(t testing.TB, hostnames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hostnames[0]},
+		DNSNames:              hostnames,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// startWebForwarder serves target on free http and https ports of 127.0.0.1 and returns the https address.
+func startWebForwarder(t testing.TB, target data.WebForwardTarget) string {
+	_, httpsAddr := serveWebForwarder(t, data.BaseConfig{ClientHelloTimeout: 5 * time.Second}, target)
+	return httpsAddr
+}
+
+// serveWebForwarder serves target on free http and https ports of 127.0.0.1 with the rest of baseConfig, and
+// returns the http and https addresses.
+func serveWebForwarder(t testing.TB, baseConfig data.BaseConfig, target data.WebForwardTarget) (string, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		waitGroup.Wait()
+	})
+	baseConfig.Http, baseConfig.Https, baseConfig.Bind = freePort(t), freePort(t), "127.0.0.1"
+	webForwarder, err := NewWebForwarder(ctx, baseConfig, waitGroup)
+	assert.NoError(t, err)
+	target.DstHost = "127.0.0.1"
+	target.Dial = func(ctx context.Context, port int) (net.Conn, error) {
+		return dialTCP(ctx, dialLoopback, port, target.TCPOptions)
+	}
+	target.DialUDP = func(ctx context.Context, port int) (net.Conn, error) {
+		return net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	}
+	webForwarder.RegisterTarget(target)
+	assert.NoError(t, webForwarder.StartAsync())
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(baseConfig.Http)),
+		net.JoinHostPort("127.0.0.1", strconv.Itoa(baseConfig.Https))
+}
+
+func TestWebForwarderHalfClose(t *testing.T) {
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "example.com")},
+	})
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	addr := startWebForwarder(t, data.WebForwardTarget{
+		Hostname:     "example.com",
+		DstHttpsPort: backend.Addr().(*net.TCPAddr).Port,
+	})
+	rawConn, err := net.Dial("tcp", addr)
+	assert.NoError(t, err)
+	defer rawConn.Close()
+	conn := tls.Client(rawConn, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.CloseWrite())
+	assert.NoError(t, rawConn.(*net.TCPConn).CloseWrite())
+	reply, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "got:ping", string(reply))
+}
+
+func TestWebForwarderClientAuth(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serveUntilEOF(t, backend)
+	serverCert := newTestCertificate(t, "example.com")
+	certFile, keyFile := writeTestCertificate(t, serverCert)
+	client := newTestCertificate(t, "client.test")
+	clientCA, _ := writeTestCertificate(t, client)
+	forwardTLS := data.ForwardTLS{TLSCert: certFile, TLSKey: keyFile, ClientCA: clientCA}
+	tlsConfig, err := forwardTLS.GetListenConfig()
+	assert.NoError(t, err)
+	addr := startWebForwarder(t, data.WebForwardTarget{
+		Hostname:     "example.com",
+		DstHttpsPort: backend.Addr().(*net.TCPAddr).Port,
+		TLSConfig:    tlsConfig,
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.Leaf)
+	// The backend receives the decrypted stream
+	assert.Equal(t, "got:ping", pingTLS(t, addr, &tls.Config{RootCAs: roots, ServerName: "example.com",
+		Certificates: []tls.Certificate{client}}))
+	assert.Empty(t, pingTLS(t, addr, &tls.Config{RootCAs: roots, ServerName: "example.com"}))
+}
+
+func TestFindHttpsTarget(t *testing.T) {
+	webForwarder, err := NewWebForwarder(context.Background(), data.BaseConfig{Https: 443}, &sync.WaitGroup{})
+	assert.NoError(t, err)
+	for _, target := range []data.WebForwardTarget{
+		{Hostname: "*example.com", DstHttpsPort: 1},
+		{Hostname: "*example.com", ALPN: []string{"acme-tls/1"}, DstHttpsPort: 2},
+		{Hostname: "*example.com", ALPN: []string{"h2"}, DstHttpsPort: 3},
+		{Hostname: "", Default: true, DstHttpsPort: 4},
+		{Hostname: "mail.example.com", ListenPort: 993, DstHttpsPort: 5},
+		{Hostname: "h2only.test", ALPN: []string{"h2"}, DstHttpsPort: 6},
+	} {
+		webForwarder.RegisterTarget(target)
+	}
+	for _, c := range []struct {
+		port       int
+		serverName string
+		protos     []string
+		dst        int
+	}{
+		{443, "a.example.com", nil, 1},
+		{443, "a.example.com", []string{"http/1.1"}, 1},
+		{443, "a.example.com", []string{"acme-tls/1"}, 2},
+		{443, "a.example.com", []string{"h2", "http/1.1"}, 3},
+		{443, "", []string{"h2"}, 4},
+		{993, "mail.example.com", nil, 5},
+		{993, "", nil, 0},
+		{443, "h2only.test", []string{"h2"}, 6},
+		{443, "h2only.test", []string{"http/1.1"}, 0},
+		{443, "other.test", nil, 0},
+	} {
+		target, ok := webForwarder.findHttpsTarget(c.port,
+			&tls.ClientHelloInfo{ServerName: c.serverName, SupportedProtos: c.protos})
+		assert.Equal(t, c.dst != 0, ok, c)
+		assert.Equal(t, c.dst, target.DstHttpsPort, c)
+	}
+}
+
+func TestWebForwarderDialPerTarget(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(request.Host))
+	}))
+	t.Cleanup(backend.Close)
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+	ctx, cancel := context.WithCancel(context.Background())
+	waitGroup := &sync.WaitGroup{}
+	t.Cleanup(func() {
+		cancel()
+		waitGroup.Wait()
+	})
+	baseConfig := data.BaseConfig{Http: freePort(t), Https: freePort(t), Bind: "127.0.0.1"}
+	webForwarder, err := NewWebForwarder(ctx, baseConfig, waitGroup)
+	assert.NoError(t, err)
+	// Two forwards of the same backend, which dial it through different outbound settings
+	var dials sync.Map
+	for _, hostname := range []string{"a.example.com", "b.example.com"} {
+		hostname := hostname
+		webForwarder.RegisterTarget(data.WebForwardTarget{
+			Hostname:    hostname,
+			DstHost:     "127.0.0.1",
+			DstHttpPort: backendPort,
+			Dial: func(ctx context.Context, port int) (net.Conn, error) {
+				dials.Store(hostname, true)
+				return dialLoopback(ctx, port)
+			},
+		})
+	}
+	assert.NoError(t, webForwarder.StartAsync())
+	for _, hostname := range []string{"a.example.com", "b.example.com"} {
+		request, err := http.NewRequest(http.MethodGet, "http://"+net.JoinHostPort("127.0.0.1",
+			strconv.Itoa(baseConfig.Http)), nil)
+		assert.NoError(t, err)
+		request.Host = hostname
+		response, err := http.DefaultClient.Do(request)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, hostname, string(body))
+		_, ok := dials.Load(hostname)
+		assert.True(t, ok, hostname)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -70,7 +71,64 @@ func openFile(dbFile string) {
 	slog.Info("Opened geo file")
 }
 
+// optionalReader is a database that may be left unconfigured and is swapped on reload. Lookups hold mu for reading,
+// so that the previous reader is only closed once no lookup uses it anymore.
+type optionalReader struct {
+	mu     sync.RWMutex
+	reader *geoip2.Reader
+	// file is only changed by open, which is not called concurrently
+	file string
+}
+
+// open replaces the reader with one of file, or with none if file is empty, and closes the previous one.
+func (o *optionalReader) open(file string) error {
+	if file == o.file {
+		return nil
+	}
+	var r *geoip2.Reader
+	if file != "" {
+		var err error
+		if r, err = geoip2.Open(file); err != nil {
+			return err
+		}
+	}
+	o.mu.Lock()
+	previous := o.reader
+	o.reader, o.file = r, file
+	o.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	if file != "" {
+		slog.Info("Opened geo file", "path", file)
+	}
+	return nil
+}
+
+// lookup calls f with the reader unless there is none.
+func (o *optionalReader) lookup(f func(r *geoip2.Reader)) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.reader != nil {
+		f(o.reader)
+	}
+}
+
+// asnReader and cityReader stay empty unless configured.
+var asnReader, cityReader optionalReader
+
+// SetupOptional opens the ASN and City databases used by ASN and region rules. Empty paths disable them.
+func SetupOptional(asnDBFile string, cityDBFile string) error {
+	if err := asnReader.open(asnDBFile); err != nil {
+		return err
+	}
+	return cityReader.open(cityDBFile)
+}
+
 func GetCountryCode(ip string) string {
+	if reader == nil {
+		return ""
+	}
 	c, err := reader.Country(net.ParseIP(ip))
 	if err != nil {
 		slog.Error("Could not get country", "ip", ip)
@@ -78,3 +136,36 @@ func GetCountryCode(ip string) string {
 	}
 	return c.Country.IsoCode
 }
+
+// GetASN returns the autonomous system number of ip, or 0 if it is unknown or no ASN database is configured.
+func GetASN(ip string) uint {
+	var asn uint
+	asnReader.lookup(func(r *geoip2.Reader) {
+		a, err := r.ASN(net.ParseIP(ip))
+		if err != nil {
+			slog.Error("Could not get asn", "ip", ip)
+			return
+		}
+		asn = a.AutonomousSystemNumber
+	})
+	return asn
+}
+
+// GetRegionCodes returns the ISO 3166-2 codes of the subdivisions of ip, like CN-GD, or nil if no City database
+// is configured.
+func GetRegionCodes(ip string) []string {
+	var codes []string
+	cityReader.lookup(func(r *geoip2.Reader) {
+		c, err := r.City(net.ParseIP(ip))
+		if err != nil {
+			slog.Error("Could not get city", "ip", ip)
+			return
+		}
+		for _, subdivision := range c.Subdivisions {
+			if subdivision.IsoCode != "" {
+				codes = append(codes, c.Country.IsoCode+"-"+subdivision.IsoCode)
+			}
+		}
+	})
+	return codes
+}
@@ -3,13 +3,15 @@ module github.com/juzeon/epok-forwarder
 go 1.21
 
 require (
-	github.com/1lann/udp-forward v0.0.0-20191015034046-6b774a53ea39
 	github.com/IGLOU-EU/go-wildcard/v2 v2.0.2
 	github.com/imroc/req/v3 v3.42.2
 	github.com/joho/godotenv v1.5.1
 	github.com/oschwald/geoip2-golang v1.9.0
 	github.com/samber/lo v1.39.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.12.0
+	golang.org/x/net v0.14.0
+	golang.org/x/sys v0.12.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -32,11 +34,8 @@ require (
 	github.com/quic-go/qtls-go1-20 v0.3.3 // indirect
 	github.com/quic-go/quic-go v0.38.1 // indirect
 	github.com/refraction-networking/utls v1.5.3 // indirect
-	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
 	golang.org/x/mod v0.12.0 // indirect
-	golang.org/x/net v0.14.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	golang.org/x/tools v0.12.1-0.20230815132531-74c255bcf846 // indirect
 )
@@ -17,6 +17,7 @@ type Flags struct {
 	reload     bool
 	help       bool
 	generate   bool
+	udpFlows   bool
 }
 
 func main() { // TODO block based on geo
@@ -25,11 +26,15 @@ func main() { // TODO block based on geo
 	flag.BoolVar(&flg.reload, "r", false, "perform hot reload")
 	flag.BoolVar(&flg.help, "h", false, "get help")
 	flag.BoolVar(&flg.generate, "g", false, "generate cli env based on the config file")
+	flag.BoolVar(&flg.udpFlows, "u", false, "list active udp flows")
 	flag.Parse()
 	cli.InitConfig()
 	if flg.reload {
 		cli.Reload()
 	}
+	if flg.udpFlows {
+		cli.UDPFlows()
+	}
 	if flg.help {
 		flag.PrintDefaults()
 		os.Exit(0)
@@ -42,6 +47,9 @@ func main() { // TODO block based on geo
 		cli.Generate(config.BaseConfig)
 	}
 	geo.Setup()
+	if err := geo.SetupOptional(config.GeoASN, config.GeoCity); err != nil {
+		util.ErrExit(err)
+	}
 	slog.Info("Starting forwarder...")
 	fwd, err := forwarder.New(config)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 )
 
 func ErrExit(err error) {
@@ -12,3 +13,39 @@ func ErrExit(err error) {
 	slog.Error("A fatal error has occurred", "err", err, "caller", file+":"+strconv.Itoa(line))
 	os.Exit(1)
 }
+
+// RunParallel calls f for every index below n on at most workers goroutines and returns the first error.
+// Remaining indexes are skipped once an error occurs.
+func RunParallel(n int, workers int, f func(i int) error) error {
+	var (
+		mu       sync.Mutex
+		next     int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if next == n || firstErr != nil {
+					mu.Unlock()
+					return
+				}
+				i := next
+				next++
+				mu.Unlock()
+				if err := f(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}